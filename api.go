@@ -1,9 +1,80 @@
 package storage
 
+import (
+	"io"
+	"time"
+)
+
 type Storager interface {
-	Put(key int64, data []byte) (err error)
+	// 分配一个新的key保存, 返回实际保存用的key
+	Put(data []byte) (key int64, err error)
+	// 从r读取size个字节保存, 返回实际保存用的key
+	PutReader(r io.Reader, size int64, opt PutOptions) (key int64, err error)
+	// 用调用者指定的key保存, key已经存在返回ErrKeyExists
+	PutWithKey(key int64, data []byte) (err error)
+	PutReaderWithKey(key int64, r io.Reader, size int64, opt PutOptions) (err error)
 	Get(key int64) (element Data, ok bool, err error)
-	GetSeq() int64
+	// 只返回索引, 不读数据
+	Stat(key int64) (index Index, ok bool, err error)
+	// 读取[offset, offset+length)范围内的数据, length小于0表示读到结尾
+	GetRange(key int64, offset, length int64) (element Data, ok bool, err error)
+	// 打开一个对象用于流式读取, 用完需要Close
+	OpenObject(key int64) (obj *Object, ok bool, err error)
 	Delete(key int64) error
+	// 从start开始按key的顺序遍历没有过期的数据, 最多limit条, limit小于等于0不限, fn返回false停止
+	Scan(start int64, limit int, fn func(key int64, index Index) bool) error
 	Close() error
 }
+
+// 写入时的可选参数
+type PutOptions struct {
+	// 过期时间, 0表示永不过期
+	TTL time.Duration
+	// 随机数, 和key一起组成对外的文件id, 防止被遍历
+	Cookie uint32
+	// 元数据, 和数据一起保存
+	Meta *Metadata
+	// 写入分配策略是PlaceHash时, 同样的hint写到组里同一个存储引擎, 存储引擎忽略
+	Hint string
+}
+
+// 可以压缩的存储引擎需要实现这个接口
+type Compacter interface {
+	// 垃圾率, 被删除的数据占数据文件的比例
+	GarbageRatio() float64
+	Compact() error
+}
+
+// 支持过期的存储引擎需要实现这个接口
+type Expirer interface {
+	// 删除now之前已经过期的数据, 返回删除的个数
+	Expire(now time.Time) (n int, err error)
+}
+
+// 能报告已用空间的存储引擎实现这个接口, 写入分配策略PlaceLeastFull用它
+type Sizer interface {
+	// 已经写入的字节数, 包括删除了还没有压缩的
+	UsedSize() int64
+}
+
+// 组要求PutWithKey的key在所有存储引擎里唯一, 存储引擎实现这个接口之后,
+// 自动分配的key也不会和别的存储引擎里调用者指定的key重复
+type KeyChecker interface {
+	// key是否已经被占用, 过期了还没有删除的和正在写的都算, 和PutWithKey返回ErrKeyExists的规则一样
+	HasKey(key int64) (bool, error)
+	// 下一个自动分配的key
+	NextKey() int64
+	// 之后自动分配的key不小于next
+	SkipKeys(next int64)
+}
+
+// 数据马上要删除的存储引擎实现这个接口, 比如删除桶
+type Discarder interface {
+	// 等正在写的Put结束之后关闭, 不写快照, 不刷盘
+	Discard() error
+}
+
+// 启动时能从崩溃中恢复的存储引擎需要实现这个接口
+type Recoverer interface {
+	Recovery() RecoveryReport
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 存储引擎后端
+// 组按Options.Backend找到工厂函数, 每个存储引擎调用一次. name是存储引擎的名字(组目录/序号),
+// 文件后端在后面加.idx/.dat/.meta. 只读打开时存储引擎不存在要返回os.ErrNotExist
+// 的错误, 组只加载已经有的存储引擎.
+// 目录锁, 名字索引和桶的配置由后端的组目录(见dir.go)保存, RegisterBackend注册的后端放在磁盘上,
+// 内存后端都放在内存里, 不碰文件系统
+
+// 打开或者新建一个存储引擎
+type BackendFactory func(name string, opt *Options) (Storager, error)
+
+const (
+	// 数据保存在.idx/.dat/.meta文件里
+	BackendFile = "file"
+	// 和文件后端的文件一样, 索引放在快照文件上, 内存里只有最近的变化和页缓存, 见disk_index.go
+	// 和BackendPackedIndex一样按组或者桶选择
+	BackendDiskIndex = "disk-index"
+	// 和文件后端的文件一样, 紧凑的内存索引, 每条16个字节, 见index_table.go
+	// 索引按组或者桶选择, 组里所有的存储引擎用同一种索引, 不能只给写满的存储引擎用
+	BackendPackedIndex = "packed-index"
+	// 数据只在内存里, 关闭之后就没有了, 用于测试
+	BackendMemory = "memory"
+)
+
+// 注册的后端
+type backend struct {
+	factory BackendFactory
+	// 打开组目录
+	openDir func(dir string, opt *Options) (groupDir, error)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]backend)
+)
+
+func init() {
+	RegisterBackend(BackendFile, openFileBackend)
+	RegisterBackend(BackendDiskIndex, func(name string, opt *Options) (Storager, error) {
+		if opt.NoSnapshot {
+			return nil, &OptionError{Field: "NoSnapshot", Value: opt.NoSnapshot, Reason: "disk-index backend needs index snapshot"}
+		}
+
+		o := *opt
+		o.DiskIndex, o.PackedIndex = true, false
+		return openFileBackend(name, &o)
+	})
+	RegisterBackend(BackendPackedIndex, func(name string, opt *Options) (Storager, error) {
+		o := *opt
+		o.PackedIndex, o.DiskIndex = true, false
+		return openFileBackend(name, &o)
+	})
+	registerBackend(BackendMemory, backend{factory: newMemoryBackend, openDir: openMemoryDir})
+}
+
+// 注册后端, 一般在init里调用, 名字重复或者factory为nil会panic
+// 组目录放在磁盘上
+func RegisterBackend(name string, factory BackendFactory) {
+	registerBackend(name, backend{factory: factory, openDir: openFileDir})
+}
+
+func registerBackend(name string, b backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if b.factory == nil {
+		panic("storage: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[name]; dup {
+		panic("storage: RegisterBackend called twice for backend " + name)
+	}
+	backends[name] = b
+}
+
+// 已经注册的后端, 按字典序排列
+func Backends() (names []string) {
+	backendsMu.RLock()
+	for name := range backends {
+		names = append(names, name)
+	}
+	backendsMu.RUnlock()
+
+	sort.Strings(names)
+	return
+}
+
+func openFileBackend(name string, opt *Options) (Storager, error) {
+	idx, err := openIndexInMemory(name, opt)
+	if err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+func lookupBackend(name string) (backend, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	b, ok := backends[name]
+	if !ok {
+		return backend{}, fmt.Errorf("%w: unknown backend %q", ErrInvalidOptions, name)
+	}
+	return b, nil
+}
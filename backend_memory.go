@@ -0,0 +1,494 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 内存后端
+// 对外的行为和文件后端一样: 自动分配的key递增, 写满返回ErrFull, 删除的空间压缩之后才回收,
+// 过期的数据get不到, 等Expire删除. 数据不落盘, 关闭之后就没有了
+
+type memoryObject struct {
+	Index
+	meta []byte
+	data []byte
+}
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	opt     Options
+	objects map[int64]*memoryObject
+	// 正在写的key
+	pending map[int64]struct{}
+	seq     int64
+	// 写入的字节数, 包括删除的, 压缩之后才减掉删除的部分
+	total int64
+	// 删除的字节数
+	deleted int64
+	full    bool
+	closed  bool
+}
+
+var (
+	_ Storager   = (*memoryStore)(nil)
+	_ Compacter  = (*memoryStore)(nil)
+	_ Expirer    = (*memoryStore)(nil)
+	_ Sizer      = (*memoryStore)(nil)
+	_ KeyChecker = (*memoryStore)(nil)
+)
+
+func newMemoryBackend(name string, opt *Options) (Storager, error) {
+	return &memoryStore{
+		opt:     *opt,
+		objects: make(map[int64]*memoryObject),
+		pending: make(map[int64]struct{}),
+	}, nil
+}
+
+func (m *memoryStore) Put(data []byte) (key int64, err error) {
+	return m.PutReader(bytes.NewReader(data), int64(len(data)), PutOptions{})
+}
+
+func (m *memoryStore) PutReader(r io.Reader, size int64, opt PutOptions) (key int64, err error) {
+	return m.putReader(0, false, r, size, opt)
+}
+
+func (m *memoryStore) PutWithKey(key int64, data []byte) (err error) {
+	return m.PutReaderWithKey(key, bytes.NewReader(data), int64(len(data)), PutOptions{})
+}
+
+func (m *memoryStore) PutReaderWithKey(key int64, r io.Reader, size int64, opt PutOptions) (err error) {
+	_, err = m.putReader(key, true, r, size, opt)
+	return
+}
+
+// 分配key, 需要持有写锁, 写满返回ErrFull, 这时还没有读r
+func (m *memoryStore) reserve(key int64, withKey bool) (int64, error) {
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+
+	if m.full {
+		return 0, ErrFull
+	}
+
+	if m.total >= int64(m.opt.SegmentSize) {
+		m.full = true
+		return 0, ErrFull
+	}
+
+	if withKey {
+		if key < 0 {
+			return 0, fmt.Errorf("%w:key(%d)", ErrIllegalKey, key)
+		}
+
+		_, ok := m.objects[key]
+		if _, pending := m.pending[key]; ok || pending {
+			return 0, fmt.Errorf("%w:key(%d)", ErrKeyExists, key)
+		}
+	} else {
+		key = m.seq
+	}
+
+	if key >= m.seq {
+		m.seq = key + 1
+	}
+	m.pending[key] = struct{}{}
+	return key, nil
+}
+
+func (m *memoryStore) HasKey(key int64) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.objects[key]
+	_, pending := m.pending[key]
+	return ok || pending, nil
+}
+
+func (m *memoryStore) NextKey() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.seq
+}
+
+func (m *memoryStore) SkipKeys(next int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if next > m.seq {
+		m.seq = next
+	}
+}
+
+// 先分配key, 不持有锁读数据, 读完再放进map
+func (m *memoryStore) putReader(key int64, withKey bool, r io.Reader, size int64, opt PutOptions) (_ int64, err error) {
+	if m.opt.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	if size < 0 || size > math.MaxInt32 {
+		return 0, fmt.Errorf("%w:%d", ErrObjectSize, size)
+	}
+
+	meta, err := encodeMeta(opt.Meta)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	key, err = m.reserve(key, withKey)
+	m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, size)
+	if _, err = io.ReadFull(r, data); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.pending, key)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.closed {
+		return 0, os.ErrClosed
+	}
+
+	obj := &memoryObject{
+		Index: Index{
+			Key:      key,
+			Size:     int32(size),
+			Offset:   m.total + int64(len(meta)),
+			Crc32:    crc32.Checksum(data, defaultTable),
+			Cookie:   opt.Cookie,
+			MetaSize: int32(len(meta)),
+		},
+		meta: meta,
+		data: data,
+	}
+	if opt.TTL > 0 {
+		obj.Timeout = time.Now().Add(opt.TTL).UnixNano()
+	}
+
+	m.objects[key] = obj
+	m.total += obj.diskSize()
+	return key, nil
+}
+
+// 没有过期的对象, 需要持有读锁
+func (m *memoryStore) lookup(key int64) (*memoryObject, bool) {
+	obj, ok := m.objects[key]
+	if !ok || obj.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+	return obj, true
+}
+
+func (m *memoryStore) Get(key int64) (element Data, ok bool, err error) {
+	return m.GetRange(key, 0, -1)
+}
+
+func (m *memoryStore) Stat(key int64) (index Index, ok bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.lookup(key)
+	if !ok {
+		return Index{}, false, nil
+	}
+	return obj.Index, true, nil
+}
+
+// 和文件后端一样, 返回的数据是复制出来的
+func (m *memoryStore) GetRange(key int64, offset, length int64) (element Data, ok bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.lookup(key)
+	if !ok {
+		return Data{}, false, nil
+	}
+
+	size := int64(obj.Size)
+	if offset < 0 || offset > size {
+		return Data{Index: obj.Index}, true, fmt.Errorf("%w:offset(%d) size(%d)", ErrRange, offset, size)
+	}
+
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+
+	element.Index = obj.Index
+	if element.Meta, err = obj.decodeMeta(); err != nil {
+		return
+	}
+	element.Data = append([]byte(nil), obj.data[offset:offset+length]...)
+	return
+}
+
+func (o *memoryObject) decodeMeta() (*Metadata, error) {
+	if len(o.meta) == 0 {
+		return nil, nil
+	}
+	return decodeMeta(o.meta)
+}
+
+func (m *memoryStore) OpenObject(key int64) (obj *Object, ok bool, err error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	o, ok := m.lookup(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	// 写入之后数据不会再改, 不用复制
+	obj = newObject(key, o.Index, io.NewSectionReader(bytes.NewReader(o.data), 0, int64(o.Size)), nil)
+	if obj.Meta, err = o.decodeMeta(); err != nil {
+		return nil, false, err
+	}
+	return obj, true, nil
+}
+
+func (m *memoryStore) Delete(key int64) error {
+	if m.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	obj, ok := m.objects[key]
+	if !ok {
+		return nil
+	}
+
+	delete(m.objects, key)
+	m.deleted += obj.diskSize()
+	return nil
+}
+
+func (m *memoryStore) Scan(start int64, limit int, fn func(key int64, index Index) bool) error {
+	now := time.Now().UnixNano()
+
+	m.mu.RLock()
+	top := newTopKeys(limit)
+	for key, obj := range m.objects {
+		if key >= start && top.wants(key) && !obj.expired(now) {
+			top.add(key, obj.Index)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, item := range top.sorted() {
+		if !fn(item.key, item.Index) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m *memoryStore) UsedSize() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.total
+}
+
+func (m *memoryStore) GarbageRatio() float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.total == 0 {
+		return 0
+	}
+	return float64(m.deleted) / float64(m.total)
+}
+
+// 回收删除的空间, 写满的存储引擎可以再写
+func (m *memoryStore) Compact() error {
+	if m.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.total -= m.deleted
+	m.deleted = 0
+	m.full = false
+	return nil
+}
+
+func (m *memoryStore) Expire(now time.Time) (n int, err error) {
+	nano := now.UnixNano()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, obj := range m.objects {
+		if obj.expired(nano) {
+			delete(m.objects, key)
+			m.deleted += obj.diskSize()
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects = nil
+	m.closed = true
+	return nil
+}
+
+// 内存里的组目录, 和内存后端一起用, 关闭之后就没有了
+type memoryDir struct {
+	mu      sync.Mutex
+	dir     string
+	names   *memoryFile
+	buckets map[string][]byte
+}
+
+func openMemoryDir(dir string, opt *Options) (groupDir, error) {
+	return &memoryDir{dir: dir, names: &memoryFile{}, buckets: make(map[string][]byte)}, nil
+}
+
+func (d *memoryDir) segments() (int, error) {
+	return 0, nil
+}
+
+func (d *memoryDir) openNames() (namesLog, error) {
+	return d.names, nil
+}
+
+func (d *memoryDir) replaceNames(data []byte) (namesLog, error) {
+	d.names = &memoryFile{data: append([]byte(nil), data...), off: int64(len(data))}
+	return d.names, nil
+}
+
+func (d *memoryDir) bucketPath(name string) string {
+	return filepath.Join(d.dir, bucketsDir, name)
+}
+
+func (d *memoryDir) listBuckets() (names []string, err error) {
+	d.mu.Lock()
+	for name := range d.buckets {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *memoryDir) readBucket(name string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	config, ok := d.buckets[name]
+	if !ok {
+		return nil, fmt.Errorf("%w:bucket %s", os.ErrNotExist, name)
+	}
+	return config, nil
+}
+
+func (d *memoryDir) createBucket(name string, config []byte) error {
+	return d.writeBucket(name, config)
+}
+
+func (d *memoryDir) writeBucket(name string, config []byte) error {
+	d.mu.Lock()
+	d.buckets[name] = append([]byte(nil), config...)
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *memoryDir) dropBucket(name string) (func() error, error) {
+	d.mu.Lock()
+	delete(d.buckets, name)
+	d.mu.Unlock()
+
+	return func() error { return nil }, nil
+}
+
+func (d *memoryDir) close() error {
+	return nil
+}
+
+// 内存里的文件, 只实现名字索引用到的方法
+type memoryFile struct {
+	data []byte
+	off  int64
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n = copy(p, f.data[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *memoryFile) Write(p []byte) (n int, err error) {
+	if end := f.off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+
+	n = copy(f.data[f.off:], p)
+	f.off += int64(n)
+	return
+}
+
+func (f *memoryFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("memoryFile seek:negative position %d", offset)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *memoryFile) Truncate(size int64) error {
+	if size < int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	return nil
+}
+
+func (f *memoryFile) Sync() error {
+	return nil
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
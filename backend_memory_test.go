@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 内存后端和文件后端的行为一样: 范围读, 流式读, 元数据, 过期, 删除, 遍历, 写满和压缩
+func Test_MemoryBackend(t *testing.T) {
+	s, err := newMemoryBackend("", &Options{SegmentSize: 2 * KB})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	key, err := s.PutReader(bytes.NewReader([]byte("hello world")), 11, PutOptions{Cookie: 7, Meta: &Metadata{Name: "a.txt"}})
+	assert.NoError(t, err)
+	assert.Equal(t, key, int64(0))
+	assert.ErrorIs(t, s.PutWithKey(key, []byte("again")), ErrKeyExists)
+	assert.ErrorIs(t, s.PutWithKey(-1, []byte("again")), ErrIllegalKey)
+
+	elem, ok, err := s.GetRange(key, 6, 3)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "wor")
+	assert.Equal(t, elem.Cookie, uint32(7))
+	assert.Equal(t, elem.Meta.Name, "a.txt")
+	_, _, err = s.GetRange(key, 12, 1)
+	assert.ErrorIs(t, err, ErrRange)
+
+	obj, ok, err := s.OpenObject(key)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	data, err := io.ReadAll(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data), "hello world")
+	assert.NoError(t, obj.Close())
+	assert.Error(t, obj.Close())
+
+	// 数据不够size个字节
+	_, err = s.PutReader(bytes.NewReader([]byte("short")), 10, PutOptions{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	_, err = s.PutReader(bytes.NewReader([]byte("expired")), 7, PutOptions{TTL: time.Nanosecond})
+	assert.NoError(t, err)
+	assert.NoError(t, s.PutWithKey(100, bytes.Repeat([]byte("x"), int(2*KB))))
+	time.Sleep(time.Millisecond)
+
+	var keys []int64
+	assert.NoError(t, s.Scan(0, 0, func(key int64, index Index) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	assert.Equal(t, keys, []int64{0, 100})
+
+	// 写满了, 删除和过期的空间压缩之后才能再写
+	_, err = s.Put([]byte("full"))
+	assert.ErrorIs(t, err, ErrFull)
+	n, err := s.(Expirer).Expire(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	assert.NoError(t, s.Delete(100))
+	assert.Greater(t, s.(Compacter).GarbageRatio(), 0.9)
+	assert.NoError(t, s.(Compacter).Compact())
+
+	key, err = s.Put([]byte("again"))
+	assert.NoError(t, err)
+	assert.Equal(t, key, int64(101))
+}
+
+// 内存后端的组不建目录, 不加目录锁, 名字索引和桶的配置都在内存里
+func Test_MemoryBackendNoDisk(t *testing.T) {
+	dir := "./testdata/memory_nodisk"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB, Backend: BackendMemory, NameIndex: true})
+	assert.NoError(t, err)
+
+	_, err = s.PutNamed("a/b.txt", []byte("hello"))
+	assert.NoError(t, err)
+	_, err = s.PutNamed("a/b.txt", []byte("hello again"))
+	assert.NoError(t, err)
+	elem, ok, err := s.GetByName("a/b.txt")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello again")
+
+	b, err := s.CreateBucket("cache", MB)
+	assert.NoError(t, err)
+	_, err = b.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.SetBucketMax("cache", 2*MB))
+	assert.Equal(t, s.ListBuckets(), []string{"cache"})
+	assert.NoError(t, s.DropBucket("cache"))
+	assert.Empty(t, s.ListBuckets())
+	assert.NoError(t, s.Close())
+
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 测试用的后端, 记录打开了多少个存储引擎
+var countingOpens int32
+
+func init() {
+	RegisterBackend("counting", func(name string, opt *Options) (Storager, error) {
+		atomic.AddInt32(&countingOpens, 1)
+		return newMemoryBackend(name, opt)
+	})
+}
+
+// 按名字选择后端, 名字重复注册会panic, 没有注册的后端打开失败
+func Test_RegisterBackend(t *testing.T) {
+	dir := "./testdata/backend"
+	os.RemoveAll(dir)
+
+	assert.Subset(t, Backends(), []string{BackendFile, BackendMemory, "counting"})
+	assert.Panics(t, func() { RegisterBackend(BackendMemory, newMemoryBackend) })
+	assert.Panics(t, func() { RegisterBackend("nil", nil) })
+
+	_, err := OpenWithOptions(dir, Options{Backend: "no-such-backend"})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+
+	atomic.StoreInt32(&countingOpens, 0)
+	s, err := OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB, Backend: "counting"})
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, atomic.LoadInt32(&countingOpens), int32(0))
+
+	index, err := s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, atomic.LoadInt32(&countingOpens), int32(1))
+	elem, ok, err := s.Get(index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+
+	// 只有目录锁, 没有存储引擎的文件
+	_, err = os.Stat(dir + "/0.dat")
+	assert.True(t, os.IsNotExist(err))
+
+	// 桶可以单独选择后端
+	_, err = s.CreateBucketWithOptions("b", BucketOptions{Max: MB, Backend: "no-such-backend"})
+	assert.ErrorIs(t, err, ErrInvalidOptions)
+	b, err := s.CreateBucketWithOptions("b", BucketOptions{Max: MB, Backend: BackendFile})
+	assert.NoError(t, err)
+	_, err = b.Put([]byte("hello"))
+	assert.NoError(t, err)
+	_, err = os.Stat(dir + "/buckets/b/0.dat")
+	assert.NoError(t, err)
+}
+
+// 磁盘索引和紧凑索引是单独的后端, 桶可以单独选择, 重新打开之后还是同样的索引
+func Test_IndexBackends(t *testing.T) {
+	for backend, table := range map[string]indexTable{
+		BackendDiskIndex:   &diskTable{},
+		BackendPackedIndex: &packedTable{},
+	} {
+		t.Run(backend, func(t *testing.T) {
+			testIndexBackend(t, backend, table)
+		})
+	}
+}
+
+func testIndexBackend(t *testing.T, backend string, table indexTable) {
+	dir := "./testdata/backend_" + backend
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB})
+	assert.NoError(t, err)
+	b, err := s.CreateBucketWithOptions("b", BucketOptions{Max: MB, Backend: backend})
+	assert.NoError(t, err)
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := b.Put([]byte(fmt.Sprintf("hello %d", i)))
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err = s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	s, err = OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	b, err = s.Bucket("b")
+	assert.NoError(t, err)
+	assert.IsType(t, b.segments()[0].(*IndexInMemory).allIndex, table)
+	assert.IsType(t, s.segments()[0].(*IndexInMemory).allIndex, mapTable{})
+
+	for i, id := range ids {
+		elem, ok, err := b.Get(id)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, string(elem.Data), fmt.Sprintf("hello %d", i))
+	}
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// 桶(命名空间)
+// 每个桶有自己的一组存储引擎, 容量单独计算
+// 桶的配置由默认的桶的组目录保存, 文件后端是buckets目录下的子目录里的bucket.json, 见dir.go
+
+const maxBucketName = 63
+
+var (
+	ErrBucketExists  = errors.New("bucket already exists")
+	ErrNoSuchBucket  = errors.New("no such bucket")
+	ErrIllegalBucket = errors.New("Illegal bucket name")
+	ErrBucketsClosed = errors.New("buckets are closed")
+)
+
+// 保存在bucket.json里的配置
+type bucketMeta struct {
+	// 桶的最大容量
+	Max Size `json:"max"`
+	// 存储引擎的后端, 空表示和存储的一样
+	Backend string `json:"backend,omitempty"`
+}
+
+type buckets struct {
+	mu     sync.RWMutex
+	home   groupDir //默认的桶的组目录, 保存桶的配置
+	opt    Options
+	groups map[string]*Group
+}
+
+// 打开所有的桶
+func openBuckets(home groupDir, opt *Options) (b *buckets, err error) {
+	b = &buckets{home: home, opt: *opt, groups: make(map[string]*Group)}
+
+	names, err := home.listBuckets()
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			b.close()
+		}
+	}()
+
+	for _, name := range names {
+		var g *Group
+		if g, err = b.open(name); err != nil {
+			return nil, fmt.Errorf("open bucket %s:%w", name, err)
+		}
+		b.groups[name] = g
+	}
+	return b, nil
+}
+
+// 打开一个桶, 容量从配置里读
+func (b *buckets) open(name string) (g *Group, err error) {
+	data, err := b.home.readBucket(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var meta bucketMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+
+	opt := b.opt
+	opt.Max = meta.Max
+	if meta.Backend != "" {
+		opt.Backend = meta.Backend
+	}
+	return loadOrNewGroup(b.home.bucketPath(name), &opt)
+}
+
+func checkBucketName(name string) error {
+	if name == "" || len(name) > maxBucketName || name[0] == '.' {
+		return fmt.Errorf("%w:%q", ErrIllegalBucket, name)
+	}
+
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return fmt.Errorf("%w:%q", ErrIllegalBucket, name)
+		}
+	}
+	return nil
+}
+
+func (b *buckets) create(name string, opt BucketOptions) (g *Group, err error) {
+	if err = checkBucketName(name); err != nil {
+		return nil, err
+	}
+
+	if b.opt.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	if opt.Max < 0 {
+		return nil, &OptionError{Field: "Max", Value: opt.Max, Reason: "must not be negative"}
+	}
+
+	if opt.Backend != "" {
+		if _, err = lookupBackend(opt.Backend); err != nil {
+			return nil, &OptionError{Field: "Backend", Value: opt.Backend, Reason: "not registered"}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.groups == nil {
+		return nil, ErrBucketsClosed
+	}
+
+	if _, ok := b.groups[name]; ok {
+		return nil, fmt.Errorf("%w:%s", ErrBucketExists, name)
+	}
+
+	data, err := json.Marshal(bucketMeta{Max: opt.Max, Backend: opt.Backend})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = b.home.createBucket(name, data); err != nil {
+		return nil, err
+	}
+
+	if g, err = b.open(name); err != nil {
+		return nil, err
+	}
+	b.groups[name] = g
+	return g, nil
+}
+
+// 调整桶的容量, 写到配置文件里, 重启之后也生效
+func (b *buckets) setMax(name string, max Size) (err error) {
+	if b.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if max < 0 {
+		return &OptionError{Field: "Max", Value: max, Reason: "must not be negative"}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[name]
+	if !ok {
+		return fmt.Errorf("%w:%s", ErrNoSuchBucket, name)
+	}
+
+	data, err := b.home.readBucket(name)
+	if err != nil {
+		return err
+	}
+
+	var meta bucketMeta
+	if err = json.Unmarshal(data, &meta); err != nil {
+		return err
+	}
+
+	meta.Max = max
+	if data, err = json.Marshal(meta); err != nil {
+		return err
+	}
+
+	if err = b.home.writeBucket(name, data); err != nil {
+		return err
+	}
+	return g.SetMax(max)
+}
+
+func (b *buckets) get(name string) (g *Group, err error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	g, ok := b.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("%w:%s", ErrNoSuchBucket, name)
+	}
+	return g, nil
+}
+
+func (b *buckets) list() (names []string) {
+	b.mu.RLock()
+	for name := range b.groups {
+		names = append(names, name)
+	}
+	b.mu.RUnlock()
+
+	sort.Strings(names)
+	return
+}
+
+// 删除桶和里面的数据
+// 持有锁的时候只把桶rename掉并从map里去掉, 关闭和删除数据的时候不持有锁, 不挡住别的桶的访问
+func (b *buckets) drop(name string) (err error) {
+	if b.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	g, remove, err := b.detach(name)
+	if err != nil {
+		return err
+	}
+
+	// 桶已经看不到了, 关闭出错也要删除数据
+	if err = g.discard(); err != nil {
+		b.opt.Logger.Printf("close bucket %s:%s", name, err)
+	}
+	return remove()
+}
+
+// 把桶从组目录和map里去掉, 返回还没有关闭的组和删除数据的函数
+func (b *buckets) detach(name string) (g *Group, remove func() error, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("%w:%s", ErrNoSuchBucket, name)
+	}
+
+	if remove, err = b.home.dropBucket(name); err != nil {
+		return nil, nil, err
+	}
+	delete(b.groups, name)
+	return g, remove, nil
+}
+
+func (b *buckets) close() (err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, g := range b.groups {
+		if e := g.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	b.groups = nil
+	return
+}
+
+// 新建桶时的选项
+type BucketOptions struct {
+	// 桶的最大容量
+	Max Size
+	// 存储引擎的后端, 空表示和存储的Options.Backend一样
+	Backend string
+}
+
+// 新建一个桶, max是桶的最大容量
+func (s Storage) CreateBucket(name string, max Size) (*Group, error) {
+	return s.buckets.create(name, BucketOptions{Max: max})
+}
+
+// 新建一个桶, 可以给桶单独选择后端
+func (s Storage) CreateBucketWithOptions(name string, opt BucketOptions) (*Group, error) {
+	return s.buckets.create(name, opt)
+}
+
+// 调整桶的最大容量, 保存在桶的配置里
+// 默认的桶用Group.SetMax调整, 重启之后用Options.Max
+func (s Storage) SetBucketMax(name string, max Size) error {
+	return s.buckets.setMax(name, max)
+}
+
+// 返回桶, 不存在返回ErrNoSuchBucket
+func (s Storage) Bucket(name string) (*Group, error) {
+	return s.buckets.get(name)
+}
+
+// 所有桶的名字, 按字典序排列
+func (s Storage) ListBuckets() []string {
+	return s.buckets.list()
+}
+
+// 删除桶和里面所有的数据
+func (s Storage) DropBucket(name string) error {
+	return s.buckets.drop(name)
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 桶之间的数据互相隔离, 重启之后桶和容量还在, 删除桶删除整个目录
+func Test_Bucket(t *testing.T) {
+	dir := "./testdata/bucket"
+	os.RemoveAll(dir)
+
+	s, err := Open(dir, GB)
+	assert.NoError(t, err)
+
+	b, err := s.CreateBucket("tenant-1", GB)
+	assert.NoError(t, err)
+	_, err = s.CreateBucket("tenant-1", GB)
+	assert.ErrorIs(t, err, ErrBucketExists)
+	_, err = s.CreateBucket("../x", GB)
+	assert.ErrorIs(t, err, ErrIllegalBucket)
+
+	index, err := b.Put([]byte("hello"))
+	assert.NoError(t, err)
+
+	// 默认的桶里没有这个数据
+	_, ok, err := s.Get(index)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// 容量保存在配置里, 重启之后还在
+	assert.NoError(t, s.SetBucketMax("tenant-1", 2*GB))
+	assert.ErrorIs(t, s.SetBucketMax("no-such-bucket", GB), ErrNoSuchBucket)
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir, GB)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, s.ListBuckets(), []string{"tenant-1"})
+
+	b, err = s.Bucket("tenant-1")
+	assert.NoError(t, err)
+	assert.Equal(t, b.Max(), 2*GB)
+	elem, ok, err := b.Get(index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+
+	assert.NoError(t, s.DropBucket("tenant-1"))
+	_, err = s.Bucket("tenant-1")
+	assert.ErrorIs(t, err, ErrNoSuchBucket)
+
+	entries, err := os.ReadDir(dir + "/buckets")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
+
+// 删除桶的数据时不持有锁, 别的桶照常访问
+type slowDropDir struct {
+	groupDir
+	during func()
+}
+
+func (d *slowDropDir) dropBucket(name string) (func() error, error) {
+	remove, err := d.groupDir.dropBucket(name)
+	return func() error {
+		d.during()
+		return remove()
+	}, err
+}
+
+func Test_BucketDropUnlocked(t *testing.T) {
+	opt := Options{Max: MB, SegmentSize: MB, Backend: BackendMemory}.withDefaults()
+	memory, err := openMemoryDir("./testdata/bucket_drop", &opt)
+	assert.NoError(t, err)
+	home := &slowDropDir{groupDir: memory}
+
+	b, err := openBuckets(home, &opt)
+	assert.NoError(t, err)
+	defer b.close()
+
+	for _, name := range []string{"a", "b"} {
+		_, err = b.create(name, BucketOptions{Max: MB})
+		assert.NoError(t, err)
+	}
+
+	home.during = func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			assert.Equal(t, b.list(), []string{"b"})
+			_, err := b.create("c", BucketOptions{Max: MB})
+			assert.NoError(t, err)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("buckets are locked while removing data")
+		}
+	}
+	assert.NoError(t, b.drop("a"))
+	assert.Equal(t, b.list(), []string{"b", "c"})
+}
+
+// 删除桶的时候还有写入, 等写入结束再关闭, 不写快照
+func Test_BucketDropWhileWriting(t *testing.T) {
+	dir := "./testdata/bucket_drop_writing"
+	os.RemoveAll(dir)
+
+	s, err := Open(dir, GB)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	b, err := s.CreateBucket("busy", GB)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 桶删除之后写入返回错误
+		for {
+			if _, err := b.Put([]byte("hello")); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, s.DropBucket("busy"))
+	<-done
+
+	entries, err := os.ReadDir(dir + "/buckets")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 0)
+}
@@ -2,18 +2,27 @@ package benchmark
 
 import (
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gnh123/storage"
 	"github.com/guonaihong/gout"
 )
 
 type Benchmark struct {
-	Server     string        `clop:"short;long" usage:"server address" valid:"required"`
+	Server     string        `clop:"short;long" usage:"server address"`
 	Put        bool          `clop:"short;long" usage:"create file"`
 	Concurrent int           `clop:"short;long" usage:"Concurrent" default:"10"`
 	Number     int           `clop:"short;long" usage:"number"`
 	Body       string        `clop:"short;long" usage:"body"`
 	Durations  time.Duration `clop:"short;long" usage:"duration"`
+
+	// 不走http, 直接在进程里写本地目录
+	Local     string `clop:"long" usage:"benchmark puts on a local dir instead of a server"`
+	Active    int    `clop:"long" usage:"number of segments written in parallel (local)" default:"1"`
+	Placement string `clop:"long" usage:"write placement: round-robin, least-full, hash (local)" default:"round-robin"`
 }
 
 func (b *Benchmark) put() {
@@ -33,7 +42,92 @@ func (b *Benchmark) put() {
 	}
 }
 
+// 并发数从1开始翻倍到Concurrent, 每一轮写Durations或者Number次, 看吞吐随并发的变化
+func (b *Benchmark) putLocal() {
+	if b.Concurrent < 1 {
+		fmt.Printf("concurrent must be at least 1, got %d\n", b.Concurrent)
+		return
+	}
+
+	placement, err := storage.ParsePlacement(b.Placement)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+
+	s, err := storage.OpenWithOptions(b.Local, storage.Options{
+		Max:            64 * storage.GB,
+		SegmentSize:    16 * storage.GB,
+		ActiveSegments: b.Active,
+		Placement:      placement,
+	})
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	defer s.Close()
+
+	body := []byte(b.Body)
+	duration := b.Durations
+	if duration <= 0 && b.Number <= 0 {
+		duration = 5 * time.Second
+	}
+
+	fmt.Printf("active segments:%d placement:%s body:%d bytes\n", b.Active, placement, len(body))
+	for c := 1; ; c *= 2 {
+		if c > b.Concurrent {
+			c = b.Concurrent
+		}
+
+		var (
+			ops    int64
+			failed int64
+			wg     sync.WaitGroup
+		)
+		deadline := time.Now().Add(duration)
+		start := time.Now()
+		for w := 0; w < c; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					if duration > 0 && time.Now().After(deadline) {
+						return
+					}
+					n := atomic.AddInt64(&ops, 1)
+					if duration <= 0 && n > int64(b.Number) {
+						atomic.AddInt64(&ops, -1)
+						return
+					}
+					if _, err := s.Put(body); err != nil {
+						atomic.AddInt64(&failed, 1)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		took := time.Since(start).Seconds()
+		fmt.Printf("concurrent:%-4d ops:%-10d failed:%-6d %12.0f ops/s %10.2f MB/s\n",
+			c, ops, failed, float64(ops)/took, float64(ops)*float64(len(body))/took/float64(storage.MB))
+
+		if c >= b.Concurrent {
+			break
+		}
+	}
+}
+
 func (b *Benchmark) SubMain() {
+	if b.Local != "" {
+		b.putLocal()
+		return
+	}
+
+	if b.Server == "" {
+		fmt.Fprintf(os.Stderr, "--server or --local is required\n")
+		return
+	}
+
 	if b.Put {
 		b.put()
 	}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gnh123/storage"
+)
+
+// 元数据和http头的对应关系
+// Content-Type                       内容类型
+// X-File-Name或者Content-Disposition  原始文件名
+// X-File-Mtime                       修改时间, http时间格式, 下载时返回Last-Modified
+// X-Meta-*                           自定义的键值对, key统一转成小写
+const (
+	headerFileName  = "X-File-Name"
+	headerFileMtime = "X-File-Mtime"
+	headerMetaPre   = "X-Meta-"
+)
+
+// 从请求头里取元数据, 一个都没有返回nil
+func metaFromHeader(h http.Header) (m *storage.Metadata, err error) {
+	meta := storage.Metadata{MIME: h.Get("Content-Type"), Name: h.Get(headerFileName)}
+	if meta.Name == "" {
+		if _, params, err := mime.ParseMediaType(h.Get("Content-Disposition")); err == nil {
+			meta.Name = params["filename"]
+		}
+	}
+
+	if v := h.Get(headerFileMtime); v != "" {
+		if meta.ModTime, err = http.ParseTime(v); err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range h {
+		if len(v) == 0 || !strings.HasPrefix(k, headerMetaPre) || len(k) == len(headerMetaPre) {
+			continue
+		}
+
+		if meta.Tags == nil {
+			meta.Tags = make(map[string]string)
+		}
+		meta.Tags[strings.ToLower(k[len(headerMetaPre):])] = v[0]
+	}
+
+	if meta.MIME == "" && meta.Name == "" && meta.ModTime.IsZero() && meta.Tags == nil {
+		return nil, nil
+	}
+	return &meta, nil
+}
+
+// 下载时把元数据写到响应头里
+func metaToHeader(m *storage.Metadata, h http.Header) {
+	if m == nil {
+		return
+	}
+
+	if m.MIME != "" {
+		h.Set("Content-Type", m.MIME)
+	}
+
+	if m.Name != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": m.Name}))
+	}
+
+	for k, v := range m.Tags {
+		h.Set(headerMetaPre+k, v)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/gnh123/storage"
+	"github.com/guonaihong/gutil/file"
+)
+
+// 把旧版本的idx记录重写成新版本, 需要先停掉server
+type Migrate struct {
+	Dir  string       `clop:"short;long" usage:"dir" valid:"required"`
+	Size storage.Size `clop:"short;long;callback=ParseSize" usage:"Maximum capacity that can be stored, same as server, example:1G 1T" `
+}
+
+// clop的callback=ParseSize会调用
+func (m *Migrate) ParseSize(val string) {
+	size, err := file.ParseSize(val)
+	if err != nil {
+		fmt.Printf("parse size fail:%s\n", err)
+		return
+	}
+
+	m.Size = storage.Size(size)
+}
+
+func (m *Migrate) SubMain() {
+	s, err := storage.OpenWithOptions(m.Dir, storage.Options{
+		Max:    m.Size,
+		Logger: log.New(os.Stderr, "storage: ", log.LstdFlags),
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+	defer s.Close()
+
+	n, err := s.Migrate()
+	if err != nil {
+		fmt.Printf("migrate:%s\n", err)
+		return
+	}
+	fmt.Printf("migrated %d segments\n", n)
+}
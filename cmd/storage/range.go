@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errRange = errors.New("invalid range")
+
+// 解析Range头, 只支持单个范围: bytes=start-end, bytes=start-, bytes=-suffix
+// 多个范围返回ok=false, 按照RFC 7233可以忽略Range返回全部数据
+func parseRange(h string, size int64) (offset, length int64, ok bool, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(h, prefix) {
+		return 0, 0, false, errRange
+	}
+
+	spec := strings.TrimSpace(h[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, nil
+	}
+
+	pos := strings.Index(spec, "-")
+	if pos == -1 {
+		return 0, 0, false, errRange
+	}
+
+	startStr, endStr := strings.TrimSpace(spec[:pos]), strings.TrimSpace(spec[pos+1:])
+	if startStr == "" {
+		// 最后suffix个字节
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false, errRange
+		}
+
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, true, nil
+	}
+
+	offset, err = strconv.ParseInt(startStr, 10, 64)
+	if err != nil || offset < 0 || offset >= size {
+		return 0, 0, false, errRange
+	}
+
+	end := size - 1
+	if endStr != "" {
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil || end < offset {
+			return 0, 0, false, errRange
+		}
+
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return offset, end - offset + 1, true, nil
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gnh123/storage"
@@ -14,18 +21,33 @@ import (
 type Storage struct {
 	Server              `clop:"subcommand" usage:"server sub command"`
 	benchmark.Benchmark `clop:"subcommand" usage:"benchmark"`
+	Migrate             `clop:"subcommand" usage:"rewrite old idx records to the current format"`
 }
 
 type Server struct {
 	Dir  string       `clop:"short;long" usage:"dir" valid:"required"`
 	Size storage.Size `clop:"short;long;callback=ParseSize" usage:"Maximum capacity that can be stored, example:1G 1T" `
-	s    storage.Storage
+
+	Sync         string        `clop:"long" usage:"sync mode: none, always, interval, group" default:"none"`
+	SyncInterval time.Duration `clop:"long" usage:"sync interval when sync mode is interval" default:"1s"`
+	PackedIndex  bool          `clop:"long" usage:"packed in-memory index, 16 bytes per object, one more idx read per get"`
+	DiskIndex    bool          `clop:"long" usage:"disk-resident index, only recent changes and a page cache in memory"`
+	Backend      string        `clop:"long" usage:"storage backend: file, disk-index, packed-index, memory" default:"file"`
+	Active       int           `clop:"long" usage:"number of segments written in parallel" default:"1"`
+	Placement    string        `clop:"long" usage:"write placement: round-robin, least-full, hash" default:"round-robin"`
+	s            storage.Storage
 }
 
 type query struct {
 	Key string `form:"key"`
 }
 
+// 写入时的参数
+type putQuery struct {
+	TTL  time.Duration `form:"ttl"`  //过期时间, 比如30s 1h, 不传表示永不过期
+	Hint string        `form:"hint"` //placement是hash时, 同一个hint写到同一个存储引擎
+}
+
 type data struct {
 	Data []byte `json:"data"`
 }
@@ -42,15 +64,40 @@ func (s *Server) ParseSize(val string) {
 }
 
 func (s *Server) createRaw(c *gin.Context) {
-	data, err := io.ReadAll(c.Request.Body)
-	if err != nil {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
+
+	var q putQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
 		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
 		return
 	}
 
-	index, err := s.s.Put(data)
+	meta, err := metaFromHeader(c.Request.Header)
 	if err != nil {
-		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		c.JSON(400, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	// 知道长度的body直接流式写到磁盘, chunked的body只能先读到内存
+	var index string
+	opt := storage.PutOptions{TTL: q.TTL, Meta: meta, Hint: q.Hint}
+	if c.Request.ContentLength >= 0 {
+		index, err = g.PutReaderWithOptions(c.Request.Body, c.Request.ContentLength, opt)
+	} else {
+		var data []byte
+		data, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+			return
+		}
+		index, err = g.PutReaderWithOptions(bytes.NewReader(data), int64(len(data)), opt)
+	}
+
+	if err != nil {
+		storageError(c, err)
 		return
 	}
 
@@ -58,22 +105,199 @@ func (s *Server) createRaw(c *gin.Context) {
 }
 
 func (s *Server) create(c *gin.Context) {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
+
+	var q putQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
 	d := data{}
 	err := c.ShouldBindJSON(&d)
 	if err != nil {
 		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
 		return
 	}
-	index, err := s.s.Put(d.Data)
+	index, err := g.PutWithTTL(d.Data, q.TTL)
 	if err != nil {
-		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		storageError(c, err)
 		return
 	}
 
 	c.JSON(200, gin.H{"code": 0, "message": "", "data": gin.H{"index": index}})
 }
 
+// url里有桶名的时候用桶, 没有用默认的桶, 桶不存在时已经返回了404
+func (s *Server) group(c *gin.Context) (*storage.Group, bool) {
+	name := c.Param("name")
+	if name == "" {
+		return s.s.Group, true
+	}
+
+	g, err := s.s.Bucket(name)
+	if err != nil {
+		storageError(c, err)
+		return nil, false
+	}
+	return g, true
+}
+
+// 桶的参数
+type bucketQuery struct {
+	Max     string `form:"max"`     //桶的最大容量, 比如1G 1T
+	Backend string `form:"backend"` //桶的存储后端, 不传和服务端的--backend一样
+}
+
+func (s *Server) createBucket(c *gin.Context) {
+	var q bucketQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	var max file.Size
+	if q.Max != "" {
+		var err error
+		if max, err = file.ParseSize(q.Max); err != nil {
+			c.JSON(400, gin.H{"code": 1, "message": err.Error()})
+			return
+		}
+	}
+
+	if _, err := s.s.CreateBucketWithOptions(c.Param("name"), storage.BucketOptions{Max: storage.Size(max), Backend: q.Backend}); err != nil {
+		storageError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"code": 0, "message": ""})
+}
+
+// 调整容量, url里有桶名的时候调整桶的容量并保存, 没有调整默认的桶, 重启之后用-s
+func (s *Server) setMax(c *gin.Context) {
+	var q bucketQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	max, err := file.ParseSize(q.Max)
+	if err != nil {
+		c.JSON(400, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	if name := c.Param("name"); name != "" {
+		err = s.s.SetBucketMax(name, storage.Size(max))
+	} else {
+		err = s.s.SetMax(storage.Size(max))
+	}
+	if err != nil {
+		storageError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"code": 0, "message": ""})
+}
+
+func (s *Server) listBuckets(c *gin.Context) {
+	c.JSON(200, gin.H{"code": 0, "message": "", "data": gin.H{"buckets": s.s.ListBuckets()}})
+}
+
+func (s *Server) dropBucket(c *gin.Context) {
+	if err := s.s.DropBucket(c.Param("name")); err != nil {
+		storageError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"code": 0, "message": ""})
+}
+
+// 分页列出文件的参数
+type listQuery struct {
+	Cursor string `form:"cursor"` //上一页返回的cursor, 为空从头开始
+	Limit  int    `form:"limit"`  //一页最多返回多少个, 默认100, 最大1000
+}
+
+// 列表里的一个文件, id不带cookie, 列表对外公开也猜不到能读数据的文件id
+type listItem struct {
+	ID      string `json:"id"`                //不带cookie, 只能用来翻页和计数
+	Size    int32  `json:"size"`              //数据的大小
+	Timeout int64  `json:"timeout,omitempty"` //过期时间, unix纳秒
+}
+
+func (s *Server) list(c *gin.Context) {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
+
+	var q listQuery
+	if err := c.ShouldBindQuery(&q); err != nil {
+		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	if q.Limit <= 0 {
+		q.Limit = 100
+	}
+	if q.Limit > 1000 {
+		q.Limit = 1000
+	}
+
+	files, next, err := g.ListFiles(q.Cursor, q.Limit)
+	if err != nil {
+		storageError(c, err)
+		return
+	}
+
+	items := make([]listItem, 0, len(files))
+	for _, f := range files {
+		id := storage.FileID{GroupIndex: f.ID.GroupIndex, Key: f.ID.Key}
+		items = append(items, listItem{ID: id.String(), Size: f.Size, Timeout: f.Timeout})
+	}
+	c.JSON(200, gin.H{"code": 0, "message": "", "data": gin.H{"files": items, "cursor": next}})
+}
+
+// 存储返回的错误, cookie不对和不存在一样处理, 不暴露文件是否存在
+func storageError(c *gin.Context, err error) {
+	if errors.Is(err, storage.ErrCookieMismatch) {
+		c.JSON(404, gin.H{"code": 1, "message": "not found"})
+		return
+	}
+	if errors.Is(err, storage.ErrNoSuchBucket) {
+		c.JSON(404, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	if errors.Is(err, storage.ErrBucketExists) {
+		c.JSON(409, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	if errors.Is(err, storage.ErrNoSpace) {
+		c.JSON(507, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	if errors.Is(err, storage.ErrObjectSize) {
+		c.JSON(413, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	if errors.Is(err, storage.ErrRange) {
+		c.JSON(416, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	if errors.Is(err, storage.ErrIllegalName) || errors.Is(err, storage.ErrIllegalBucket) || errors.Is(err, storage.ErrIllegalKey) ||
+		errors.Is(err, storage.ErrInvalidOptions) {
+		c.JSON(400, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+	c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+}
+
 func (s *Server) delete(c *gin.Context) {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
 
 	var q query
 	err := c.ShouldBindQuery(&q)
@@ -82,11 +306,19 @@ func (s *Server) delete(c *gin.Context) {
 		return
 	}
 
-	s.s.Delete(q.Key)
+	if err = g.Delete(q.Key); err != nil {
+		storageError(c, err)
+		return
+	}
 	c.JSON(200, gin.H{"code": 0, "message": ""})
 }
 
 func (s *Server) get(c *gin.Context) {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
+
 	var q query
 	err := c.ShouldBindQuery(&q)
 	if err != nil {
@@ -94,9 +326,14 @@ func (s *Server) get(c *gin.Context) {
 		return
 	}
 
-	elem, ok, err := s.s.Get(q.Key)
+	if h := c.GetHeader("Range"); h != "" {
+		getRange(c, g, q.Key, h)
+		return
+	}
+
+	elem, ok, err := g.Get(q.Key)
 	if err != nil {
-		c.JSON(500, gin.H{"code": 0, "message": err.Error()})
+		storageError(c, err)
 		return
 	}
 	if !ok {
@@ -109,22 +346,224 @@ func (s *Server) get(c *gin.Context) {
 
 }
 
-func (s *Server) SubMain() {
+// json接口里的范围, 整个对象的大小是size
+type rangeInfo struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+	Size   int64 `json:"size"`
+}
+
+// 带Range头的json请求, 还是返回200, data里只有范围内的数据, 范围放在range字段里
+// 206和Content-Range只用在原始数据的接口上(ServeContent), json的响应体不是对象的字节
+// 空对象和多个范围忽略Range头, 返回整个对象, 没有range字段
+func getRange(c *gin.Context, g *storage.Group, key string, h string) {
+	// 先读0个字节拿到对象大小
+	elem, ok, err := g.GetRange(key, 0, 0)
+	if err != nil {
+		storageError(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"code": 1, "message": "not found"})
+		return
+	}
+
+	size := int64(elem.Size)
+	var offset, length int64
+	ranged := false
+	if size > 0 {
+		if offset, length, ranged, err = parseRange(h, size); err != nil {
+			c.JSON(416, gin.H{"code": 1, "message": fmt.Sprintf("%s, size:%d", err, size)})
+			return
+		}
+	}
+
+	if !ranged {
+		offset, length = 0, -1
+	}
+
+	elem, ok, err = g.GetRange(key, offset, length)
+	if err != nil {
+		storageError(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"code": 1, "message": "not found"})
+		return
+	}
+
+	if !ranged {
+		c.JSON(200, gin.H{"code": 0, "message": "", "data": elem})
+		return
+	}
+	c.JSON(200, gin.H{"code": 0, "message": "", "data": elem, "range": rangeInfo{Offset: offset, Length: length, Size: size}})
+}
+
+// 直接返回原始数据, 从磁盘流式读取
+func (s *Server) getRaw(c *gin.Context) {
+	g, ok := s.group(c)
+	if !ok {
+		return
+	}
+
+	var q query
+	err := c.ShouldBindQuery(&q)
+	if err != nil {
+		c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+		return
+	}
+
+	obj, ok, err := g.OpenObject(q.Key)
+	serveObject(c, obj, ok, err)
+}
+
+// 流式返回对象的原始数据
+func serveObject(c *gin.Context, obj *storage.Object, ok bool, err error) {
+	if err != nil {
+		storageError(c, err)
+		return
+	}
+	if !ok {
+		c.JSON(404, gin.H{"code": 1, "message": "not found"})
+		return
+	}
+	defer obj.Close()
+
+	// ServeContent会处理Range头, 返回206或者416
+	// 读整个对象时会校验crc, ServeContent会忽略拷贝过程中的错误, 所以记下来,
+	// 出错的时候头已经发出去了, 只能断开连接让客户端知道数据不完整
+	var modTime time.Time
+	if obj.Meta != nil {
+		modTime = obj.Meta.ModTime
+	}
+	metaToHeader(obj.Meta, c.Writer.Header())
 
+	o := &errObject{Object: obj}
+	http.ServeContent(c.Writer, c.Request, "", modTime, o)
+	if o.err != nil {
+		if conn, _, err := c.Writer.Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+// 对象的名字, 去掉开头的/
+func objectName(c *gin.Context) string {
+	return strings.TrimPrefix(c.Param("path"), "/")
+}
+
+// 用名字保存, 名字已经存在就覆盖
+func (s *Server) putObject(c *gin.Context) {
+	var index string
 	var err error
-	r := gin.Default()
+	if c.Request.ContentLength >= 0 {
+		index, err = s.s.PutNamedReader(objectName(c), c.Request.Body, c.Request.ContentLength)
+	} else {
+		var data []byte
+		data, err = io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(500, gin.H{"code": 1, "message": err.Error()})
+			return
+		}
+		index, err = s.s.PutNamed(objectName(c), data)
+	}
 
-	s.s, err = storage.Open(s.Dir, s.Size)
 	if err != nil {
-		fmt.Printf("%s\n", err)
+		storageError(c, err)
 		return
 	}
 
+	c.JSON(200, gin.H{"code": 0, "message": "", "data": gin.H{"index": index}})
+}
+
+// 用名字读取原始数据
+func (s *Server) getObject(c *gin.Context) {
+	obj, ok, err := s.s.OpenObjectByName(objectName(c))
+	serveObject(c, obj, ok, err)
+}
+
+func (s *Server) deleteObject(c *gin.Context) {
+	if err := s.s.DeleteByName(objectName(c)); err != nil {
+		storageError(c, err)
+		return
+	}
+	c.JSON(200, gin.H{"code": 0, "message": ""})
+}
+
+// 记录读数据时的错误
+type errObject struct {
+	*storage.Object
+	err error
+}
+
+func (o *errObject) Read(p []byte) (n int, err error) {
+	n, err = o.Object.Read(p)
+	if err != nil && err != io.EOF {
+		o.err = err
+	}
+	return
+}
+
+// 注册所有的接口
+func (s *Server) routes(r *gin.Engine) {
 	r.POST("/file", s.create)
 	r.POST("/file/raw", s.createRaw)
 	r.DELETE("/file", s.delete)
 	r.GET("/file", s.get)
+	r.GET("/file/raw", s.getRaw)
+	r.GET("/files", s.list)
+	r.PUT("/max", s.setMax)
+	r.GET("/bucket", s.listBuckets)
+	r.PUT("/bucket/:name", s.createBucket)
+	r.DELETE("/bucket/:name", s.dropBucket)
+	b := r.Group("/bucket/:name")
+	b.POST("/file", s.create)
+	b.POST("/file/raw", s.createRaw)
+	b.DELETE("/file", s.delete)
+	b.GET("/file", s.get)
+	b.GET("/file/raw", s.getRaw)
+	b.GET("/files", s.list)
+	b.PUT("/max", s.setMax)
+
+	r.PUT("/obj/*path", s.putObject)
+	r.GET("/obj/*path", s.getObject)
+	r.DELETE("/obj/*path", s.deleteObject)
+}
+
+func (s *Server) SubMain() {
+
+	r := gin.Default()
+
+	syncMode, err := storage.ParseSyncMode(s.Sync)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+
+	placement, err := storage.ParsePlacement(s.Placement)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
+
+	s.s, err = storage.OpenWithOptions(s.Dir, storage.Options{
+		Max:            s.Size,
+		Sync:           syncMode,
+		SyncInterval:   s.SyncInterval,
+		Logger:         log.New(os.Stderr, "storage: ", log.LstdFlags),
+		NameIndex:      true,
+		PackedIndex:    s.PackedIndex,
+		DiskIndex:      s.DiskIndex,
+		Backend:        s.Backend,
+		ActiveSegments: s.Active,
+		Placement:      placement,
+	})
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		return
+	}
 
+	s.routes(r)
 	r.Run()
 }
 
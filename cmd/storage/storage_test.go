@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gnh123/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestServer(t *testing.T) (*Server, *gin.Engine) {
+	dir := "./testdata/server"
+	os.RemoveAll(dir)
+	os.MkdirAll("./testdata", 0755)
+
+	s := &Server{}
+	var err error
+	s.s, err = storage.OpenWithOptions(dir, storage.Options{Max: storage.GB})
+	assert.NoError(t, err)
+	t.Cleanup(func() {
+		s.s.Close()
+		os.RemoveAll("./testdata")
+	})
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	s.routes(r)
+	return s, r
+}
+
+func do(r *gin.Engine, method, url, rangeHeader, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+type getResult struct {
+	Data struct {
+		Data []byte `json:"data"`
+	} `json:"data"`
+	Range *rangeInfo `json:"range"`
+}
+
+// json接口的范围读返回200, 范围在range字段里; 原始数据的接口返回206
+func Test_GetRange(t *testing.T) {
+	s, r := newTestServer(t)
+
+	full, err := s.s.Put([]byte("hello world"))
+	assert.NoError(t, err)
+	empty, err := s.s.Put(nil)
+	assert.NoError(t, err)
+
+	get := func(key, h string) (int, getResult, http.Header) {
+		w := do(r, "GET", "/file?key="+key, h, "")
+		var res getResult
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return w.Code, res, w.Header()
+	}
+
+	code, res, header := get(full, "bytes=0-4")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, string(res.Data.Data), "hello")
+	assert.Equal(t, res.Range, &rangeInfo{Offset: 0, Length: 5, Size: 11})
+	assert.Empty(t, header.Get("Content-Range"))
+
+	// 多个范围返回整个对象
+	code, res, _ = get(full, "bytes=0-1,3-4")
+	assert.Equal(t, code, 200)
+	assert.Equal(t, string(res.Data.Data), "hello world")
+	assert.Nil(t, res.Range)
+
+	// 空对象忽略Range
+	code, res, header = get(empty, "bytes=-5")
+	assert.Equal(t, code, 200)
+	assert.Empty(t, res.Data.Data)
+	assert.Nil(t, res.Range)
+	assert.Empty(t, header.Get("Content-Range"))
+
+	code, _, _ = get(full, "bytes=20-")
+	assert.Equal(t, code, 416)
+
+	w := do(r, "GET", "/file/raw?key="+full, "bytes=6-", "")
+	assert.Equal(t, w.Code, 206)
+	assert.Equal(t, w.Header().Get("Content-Range"), "bytes 6-10/11")
+	assert.Equal(t, w.Body.String(), "world")
+
+	w = do(r, "GET", "/file/raw?key="+full, "bytes=0-1,3-4", "")
+	assert.Equal(t, w.Code, 206)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges"))
+
+	w = do(r, "GET", "/file/raw?key="+empty, "bytes=0-", "")
+	assert.Equal(t, w.Code, 200)
+	assert.Empty(t, w.Header().Get("Content-Range"))
+}
+
+// 对象太大返回413, 不是服务端的错误
+func Test_CreateRawTooLarge(t *testing.T) {
+	_, r := newTestServer(t)
+
+	req := httptest.NewRequest("POST", "/file/raw", strings.NewReader(""))
+	req.ContentLength = math.MaxInt32 + 1
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 413)
+}
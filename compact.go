@@ -0,0 +1,423 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// 压缩流程
+// 1. 拍一个内存索引的快照, 不持有锁把快照里活着的数据写到.idx.compact和.dat.compact
+// 2. 加写锁, 把压缩期间新写入和新删除的数据追加到新文件
+// 3. 创建.compact标记文件, 之后依次把新文件rename成正式文件, 最后删除标记文件
+// 启动的时候如果发现标记文件, 说明替换做了一半, 继续把rename做完;
+// 没有标记文件只有临时文件, 说明压缩没有完成, 直接删除临时文件
+// 只读打开的进程会对索引文件加共享锁, 替换期间对新旧索引文件都加排他锁, 有读者的时候不替换
+
+var (
+	ErrCompacting = errors.New("compaction is running")
+	// 有只读打开的进程在使用这个存储引擎, 不能替换文件
+	ErrInUse = errors.New("segment is in use by a read-only reader")
+)
+
+const compactSuffix = ".compact"
+
+// 生成压缩标记文件名
+func compactName(fileName string) string {
+	return fileName + compactSuffix
+}
+
+// 压缩的时候用于写新文件
+type compactWriter struct {
+	idx *os.File
+	dat *os.File
+
+	idxOffset int64
+	datOffset int64
+
+	allIndex indexTable
+}
+
+func newCompactWriter(name string, size int, opt *Options) (w *compactWriter, err error) {
+	w = &compactWriter{}
+
+	w.idx, err = os.OpenFile(idxName(name)+compactSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, opt.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	w.allIndex = newIndexTable(opt, w.idx, size)
+
+	w.dat, err = os.OpenFile(datName(name)+compactSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, opt.FileMode)
+	if err != nil {
+		w.idx.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// 从旧的数据文件复制一条数据
+func (w *compactWriter) copyFrom(dat *os.File, key int64, index Index) error {
+	// 元数据和数据一起复制
+	data := make([]byte, index.diskSize())
+	if _, err := dat.ReadAt(data, index.Offset-int64(index.MetaSize)); err != nil && err != io.EOF {
+		return err
+	}
+
+	index.Offset = w.datOffset + int64(index.MetaSize)
+	buf, err := encodePut(key, &index)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.dat.WriteAt(data, w.datOffset); err != nil {
+		return err
+	}
+
+	if _, err = w.idx.Write(buf); err != nil {
+		return err
+	}
+
+	w.allIndex.set(key, index, w.idxOffset)
+	w.datOffset += int64(len(data))
+	w.idxOffset += int64(len(buf))
+	return nil
+}
+
+// 快照之后被删除的数据, 在新文件中写入墓碑记录
+func (w *compactWriter) delete(key int64) error {
+	buf, err := encodeDelete(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err = w.idx.Write(buf); err != nil {
+		return err
+	}
+
+	w.allIndex.delete(key)
+	w.idxOffset += int64(len(buf))
+	return nil
+}
+
+func (w *compactWriter) sync() error {
+	if err := w.idx.Sync(); err != nil {
+		return err
+	}
+	return w.dat.Sync()
+}
+
+// 压缩失败, 清理临时文件
+func (w *compactWriter) remove() {
+	w.idx.Close()
+	w.dat.Close()
+	os.Remove(w.idx.Name())
+	os.Remove(w.dat.Name())
+}
+
+// 启动时恢复压缩的中间状态, 返回true表示完成了一次文件替换
+func recoverCompact(name string) (bool, error) {
+	tmpFiles := []string{idxName(name), datName(name)}
+
+	_, err := os.Stat(compactName(name))
+	if os.IsNotExist(err) {
+		for _, f := range tmpFiles {
+			os.Remove(f + compactSuffix)
+		}
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	for _, f := range tmpFiles {
+		if _, err = os.Stat(f + compactSuffix); os.IsNotExist(err) {
+			// 已经rename过了
+			continue
+		}
+
+		if err = os.Rename(f+compactSuffix, f); err != nil {
+			return false, err
+		}
+	}
+
+	if err = syncDir(name); err != nil {
+		return false, err
+	}
+
+	if err = os.Remove(compactName(name)); err != nil {
+		return false, err
+	}
+	return true, syncDir(name)
+}
+
+// 垃圾率, 被删除的数据占数据文件的比例
+func (i *IndexInMemory) GarbageRatio() float64 {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
+
+	if i.DatOffset == 0 {
+		return 0
+	}
+	return float64(i.DeleteSize) / float64(i.DatOffset)
+}
+
+// 已经写入的字节数
+func (i *IndexInMemory) UsedSize() int64 {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
+	return i.TotalSize
+}
+
+// 根据内存索引重新计算元数据
+func (i *IndexInMemory) resetMetadata() error {
+	i.TotalSize = 0
+	i.DatOffset = 0
+	err := i.allIndex.each(0, func(key int64, index Index) bool {
+		i.TotalSize += index.diskSize()
+		if end := index.Offset + int64(index.Size); end > i.DatOffset {
+			i.DatOffset = end
+		}
+
+		if key >= i.Seq {
+			i.Seq = key + 1
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	i.FileCount = i.allIndex.len()
+	i.DeleteCount = 0
+	i.DeleteSize = 0
+	i.Readonly = i.TotalSize >= int64(i.opt.SegmentSize)
+	return nil
+}
+
+// 返回idx里[from, to)之间的记录涉及的key, 去掉重复的
+func (i *IndexInMemory) idxKeys(from, to int64) (keys []int64, err error) {
+	buf := make([]byte, to-from)
+	if _, err = i.idx.ReadAt(buf, from); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int64]struct{})
+	for len(buf) >= 4 {
+		h := binary.LittleEndian.Uint32(buf)
+		l := int(h & recordLenMask)
+		if 4+l > len(buf) {
+			return nil, fmt.Errorf("%w:torn idx record at %d", ErrBadData, to-int64(len(buf)))
+		}
+
+		key, _, _, err := decodeRecord(h>>recordTypeShift, buf[4:4+l])
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+		buf = buf[4+l:]
+	}
+	return keys, nil
+}
+
+type compactItem struct {
+	key int64
+	Index
+}
+
+// 压缩, 把活着的数据重写到新的.dat/.idx文件, 然后原子替换旧文件
+// 压缩期间读写都可以继续, 已经返回给客户端的key保持不变
+func (i *IndexInMemory) Compact() (err error) {
+	if i.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if !i.compactMu.TryLock() {
+		return ErrCompacting
+	}
+	defer i.compactMu.Unlock()
+
+	if err = i.compact(); err != nil {
+		return err
+	}
+
+	// 磁盘索引压缩之后都在内存里, 马上写成查找文件
+	if i.opt.DiskIndex {
+		return i.autoSnapshot()
+	}
+	return nil
+}
+
+// 需要持有compactMu
+func (i *IndexInMemory) compact() (err error) {
+	// 1. 拍快照, 按offset排序, 顺序读旧的数据文件
+	// 已经过期的数据不用复制, 记下快照时idx的位置, 之后的变化从idx尾部找
+	now := time.Now().UnixNano()
+	i.rwmu.RLock()
+	snapIdx := i.idxOffset
+	items := make([]compactItem, 0, i.allIndex.len())
+	err = i.allIndex.each(0, func(key int64, index Index) bool {
+		if !index.expired(now) {
+			items = append(items, compactItem{key: key, Index: index})
+		}
+		return true
+	})
+	i.rwmu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(items, func(a, b int) bool {
+		return items[a].Offset < items[b].Offset
+	})
+
+	w, err := newCompactWriter(i.name, len(items), &i.opt)
+	if err != nil {
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			w.remove()
+		}
+	}()
+
+	// 只有压缩会替换i.dat, 这里不用加锁
+	for _, item := range items {
+		if err = w.copyFrom(i.dat, item.key, item.Index); err != nil {
+			return err
+		}
+	}
+
+	// 2. 追上压缩期间的写入和删除
+	// 等正在写数据的Put结束, 它们预留的空间在旧文件里
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	i.rwmu.Lock()
+	defer i.rwmu.Unlock()
+
+	// 快照之后idx里出现的key, 还活着说明是新写入的, 否则是被删除了
+	keys, err := i.idxKeys(snapIdx, i.idxOffset)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		index, ok, err := i.allIndex.get(key)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			if err = w.copyFrom(i.dat, key, index); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if ok, err = w.allIndex.has(key); err != nil {
+			return err
+		}
+		if ok {
+			if err = w.delete(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err = w.sync(); err != nil {
+		return err
+	}
+
+	// 3. 原子替换
+	ok, err := tryLockExclusive(i.idx)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrInUse
+	}
+
+	// 新文件要等替换完成之后才能被读者打开
+	if _, err = tryLockExclusive(w.idx); err != nil {
+		unlock(i.idx)
+		return err
+	}
+	defer unlock(w.idx)
+
+	// 快照对应的是旧的idx
+	if err = removeSnapshot(i.name); err != nil {
+		unlock(i.idx)
+		return err
+	}
+
+	marker, err := os.OpenFile(compactName(i.name), os.O_CREATE|os.O_RDWR, i.opt.FileMode)
+	if err != nil {
+		unlock(i.idx)
+		return err
+	}
+	err = marker.Sync()
+	marker.Close()
+	if err == nil {
+		// 标记文件的目录项也要落盘, 不然崩溃之后可能看到rename了一半却没有标记文件
+		err = syncDir(i.name)
+	}
+	if err != nil {
+		unlock(i.idx)
+		return err
+	}
+
+	// 标记文件已经落盘, 后面的步骤失败了下次启动也会继续完成
+	committed = true
+	for _, f := range []string{idxName(i.name), datName(i.name)} {
+		if err = os.Rename(f+compactSuffix, f); err != nil {
+			// 旧文件已经不完整了, 不能再往里面写
+			i.Readonly = true
+			unlock(i.idx)
+			return err
+		}
+	}
+
+	// rename落盘之后才能删除标记文件
+	if err = syncDir(i.name); err != nil {
+		i.Readonly = true
+		unlock(i.idx)
+		return err
+	}
+
+	i.fileMu.Lock()
+	i.idx.Close()
+	i.dat.Close()
+	i.idx, i.dat = w.idx, w.dat
+	i.fileMu.Unlock()
+	i.idxOffset = w.idxOffset
+	i.oldRecords = 0
+	i.snapOffset = -1
+	if c, ok := i.allIndex.(io.Closer); ok {
+		c.Close()
+	}
+	i.allIndex = w.allIndex
+	if err = i.resetMetadata(); err != nil {
+		return err
+	}
+	i.datEnd = i.DatOffset
+	i.updateMetadata()
+	if err = i.md.Sync(); err != nil {
+		return err
+	}
+
+	if err = os.Remove(compactName(i.name)); err != nil {
+		return err
+	}
+	return syncDir(i.name)
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func removeIndexFiles(name string) {
+	os.Remove(idxName(name))
+	os.Remove(datName(name))
+	os.Remove(metaName(name))
+	os.Remove(compactName(name))
+	os.Remove(snapName(name))
+}
+
+// 压缩之后删除的空间被回收, 没删除的数据还能get出来, 重启之后也一样
+func Test_Compact(t *testing.T) {
+	name := "./testdata/compact"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+
+	for i := int64(0); i < 10; i++ {
+		err = index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i)))
+		assert.NoError(t, err)
+	}
+
+	for i := int64(0); i < 10; i += 2 {
+		assert.NoError(t, index.Delete(i))
+	}
+
+	assert.Greater(t, index.GarbageRatio(), 0.4)
+	before := index.DatOffset
+
+	assert.NoError(t, index.Compact())
+	assert.Equal(t, index.GarbageRatio(), 0.0)
+	assert.Less(t, index.DatOffset, before)
+
+	fi, err := os.Stat(datName(name))
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), index.DatOffset)
+
+	check := func(index *IndexInMemory) {
+		for i := int64(0); i < 10; i++ {
+			elem, ok, err := index.Get(i)
+			assert.NoError(t, err)
+			assert.Equal(t, ok, i%2 == 1)
+			if ok {
+				assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+			}
+		}
+	}
+
+	check(index)
+
+	// 压缩之后还能继续写
+	assert.NoError(t, index.PutWithKey(10, []byte("hello world:10")))
+	assert.NoError(t, index.Close())
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	check(index)
+	elem, ok, err := index.Get(10)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, elem.Data, []byte("hello world:10"))
+}
+
+// 有标记文件时, 启动会把没rename完的临时文件替换过去
+func Test_RecoverCompact(t *testing.T) {
+	name := "./testdata/compact_recover"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	assert.NoError(t, index.PutWithKey(0, []byte("hello")))
+	assert.NoError(t, index.Close())
+
+	// 模拟rename完idx之后退出
+	os.WriteFile(compactName(name), nil, 0644)
+	data, err := os.ReadFile(datName(name))
+	assert.NoError(t, err)
+	os.WriteFile(datName(name)+compactSuffix, data, 0644)
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	_, err = os.Stat(compactName(name))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(datName(name) + compactSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	elem, ok, err := index.Get(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, elem.Data, []byte("hello"))
+}
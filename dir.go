@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 组的目录
+// 组自己的状态放在这里: 目录锁, 已经有哪些存储引擎, 名字索引的日志和桶的配置.
+// 文件后端放在磁盘上的组目录里, 内存后端都放在内存里, 不碰文件系统.
+// 后端注册的时候决定用哪一种, 见backend.go
+
+type groupDir interface {
+	// 已经有的存储引擎个数
+	segments() (int, error)
+	// 打开名字索引的日志, 只读打开时写进程还没有创建返回nil
+	openNames() (namesLog, error)
+	// 用data替换名字索引的日志, 返回新的日志, 位置在结尾
+	replaceNames(data []byte) (namesLog, error)
+	// 所有的桶, 写进程打开时顺便清理没有做完的新建和删除
+	listBuckets() ([]string, error)
+	// 读桶的配置
+	readBucket(name string) ([]byte, error)
+	// 新建桶, 配置写好之后桶才出现
+	createBucket(name string, config []byte) error
+	// 替换桶的配置
+	writeBucket(name string, config []byte) error
+	// 删除桶, 桶马上消失, 返回的函数删除里面的数据, 可以在不持有锁的时候调用
+	dropBucket(name string) (remove func() error, err error)
+	// 桶的组目录
+	bucketPath(name string) string
+	// 释放目录锁
+	close() error
+}
+
+// 名字索引的日志, *os.File满足这个接口
+type namesLog interface {
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// 磁盘上的组目录
+// 桶是buckets目录下的子目录, 配置保存在子目录下的bucket.json里.
+// 新建时先在.new-前缀的临时目录里写好配置再rename, 删除时先rename成.trash-前缀再删除目录,
+// 所以删除一个桶不用遍历里面的数据, 中间崩溃了下次打开时清理临时目录
+
+const (
+	bucketsDir     = "buckets"
+	bucketConfig   = "bucket.json"
+	bucketNewPre   = ".new-"
+	bucketTrashPre = ".trash-"
+)
+
+type fileDir struct {
+	dir  string
+	opt  *Options
+	lock *os.File //目录锁, 只读打开时为nil
+}
+
+// 打开组目录, 不存在时新建, 写进程加目录锁
+func openFileDir(dir string, opt *Options) (groupDir, error) {
+	// 检查目录是否存在
+	_, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		// 只读打开不能新建
+		if opt.ReadOnly {
+			return nil, err
+		}
+
+		// 不存在新建一个
+		os.Mkdir(dir, opt.DirMode)
+	}
+
+	d := &fileDir{dir: dir, opt: opt}
+	// 加目录锁之后才能恢复和修改文件
+	if !opt.ReadOnly {
+		if d.lock, err = lockDir(dir, opt.FileMode); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// 按目录里已经有的文件(序号.idx, 序号.dat...)算出存储引擎的个数
+// 存储引擎按序号依次新建, 中间缺了说明被删掉了, 再新建会复用这个序号, 旧的文件id就指向了别的数据
+func (d *fileDir) segments() (count int, err error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	seen := make(map[int]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(e.Name(), ".")
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 || strconv.Itoa(n) != name {
+			continue
+		}
+
+		seen[n] = true
+		if n >= count {
+			count = n + 1
+		}
+	}
+
+	for n := 0; n < count; n++ {
+		if !seen[n] {
+			return 0, fmt.Errorf("%w:segment %d of %d in %s", ErrMissingSegment, n, count, d.dir)
+		}
+	}
+	return count, nil
+}
+
+func (d *fileDir) openNames() (namesLog, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if d.opt.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
+	f, err := os.OpenFile(filepath.Join(d.dir, namesFile), flag, d.opt.FileMode)
+	if err != nil {
+		// 只读打开时写进程还没有创建名字索引, 当成空的
+		if d.opt.ReadOnly && os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// 先写临时文件, 落盘之后rename, 中间崩溃了还是旧的日志
+func (d *fileDir) replaceNames(data []byte) (namesLog, error) {
+	path := filepath.Join(d.dir, namesFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, d.opt.FileMode)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return f, nil
+}
+
+func (d *fileDir) bucketsDir() string {
+	return filepath.Join(d.dir, bucketsDir)
+}
+
+func (d *fileDir) bucketPath(name string) string {
+	return filepath.Join(d.bucketsDir(), name)
+}
+
+func (d *fileDir) listBuckets() (names []string, err error) {
+	entries, err := os.ReadDir(d.bucketsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+
+		name := e.Name()
+		if strings.HasPrefix(name, ".") {
+			// 没有做完的新建和删除
+			if !d.opt.ReadOnly && (strings.HasPrefix(name, bucketNewPre) || strings.HasPrefix(name, bucketTrashPre)) {
+				os.RemoveAll(filepath.Join(d.bucketsDir(), name))
+			}
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (d *fileDir) readBucket(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(d.bucketPath(name), bucketConfig))
+}
+
+func (d *fileDir) createBucket(name string, config []byte) (err error) {
+	if err = os.MkdirAll(d.bucketsDir(), d.opt.DirMode); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(d.bucketsDir(), bucketNewPre+name)
+	os.RemoveAll(tmp)
+	if err = os.Mkdir(tmp, d.opt.DirMode); err != nil {
+		return err
+	}
+
+	if err = os.WriteFile(filepath.Join(tmp, bucketConfig), config, d.opt.FileMode); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, d.bucketPath(name)); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+func (d *fileDir) writeBucket(name string, config []byte) (err error) {
+	path := filepath.Join(d.bucketPath(name), bucketConfig)
+	tmp := path + bucketNewPre
+	if err = os.WriteFile(tmp, config, d.opt.FileMode); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// rename之后桶就没有了, 整个目录在返回的函数里删除
+func (d *fileDir) dropBucket(name string) (func() error, error) {
+	trash := filepath.Join(d.bucketsDir(), fmt.Sprintf("%s%s-%d", bucketTrashPre, name, time.Now().UnixNano()))
+	if err := os.Rename(d.bucketPath(name), trash); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return os.RemoveAll(trash)
+	}, nil
+}
+
+func (d *fileDir) close() (err error) {
+	if d.lock != nil {
+		err = unlockDir(d.lock)
+		d.lock = nil
+	}
+	return
+}
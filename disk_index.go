@@ -0,0 +1,552 @@
+package storage
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+)
+
+// 磁盘索引
+// 索引快照(见snapshot.go)本身就是按key排序, 分页带校验的文件, 磁盘索引不把它加载到内存,
+// 而是当成只读的查找文件, 先按每页的第一个key二分查找页, 再在页里二分查找, 页缓存在LRU里.
+// 快照之后的写入和删除放在内存的小map里, 攒够minRecent条或者还没有查找文件时,
+// 定时任务和Close把小map和查找文件归并成新的查找文件.
+// 写满的存储引擎不再写入, 内存里只有页缓存和有过期时间的key
+//
+// 写新的查找文件期间, 小map冻结成frozen, 新的变化写到新的小map里, 查找的顺序是
+// recent -> frozen -> 查找文件
+
+var errStopIter = errors.New("stop iteration")
+
+type diskEntry struct {
+	Index
+	deleted bool
+}
+
+type diskTable struct {
+	cacheSize Size
+	lookup    *lookupFile
+	// 正在写到新的查找文件里的变化
+	frozen map[int64]diskEntry
+	// 最近的变化, 删除查找文件里的key时记一条deleted
+	recent map[int64]diskEntry
+	live   int
+}
+
+func newDiskTable(cacheSize Size) *diskTable {
+	if cacheSize <= 0 {
+		cacheSize = DefaultDiskIndexCache
+	}
+	return &diskTable{cacheSize: cacheSize, recent: make(map[int64]diskEntry)}
+}
+
+// 在内存的变化里查找, found为true表示有记录, 包括删除
+func (d *diskTable) memGet(key int64) (e diskEntry, found bool) {
+	if e, found = d.recent[key]; found {
+		return
+	}
+	e, found = d.frozen[key]
+	return
+}
+
+func (d *diskTable) get(key int64) (index Index, ok bool, err error) {
+	if e, found := d.memGet(key); found {
+		return e.Index, !e.deleted, nil
+	}
+
+	if d.lookup == nil {
+		return index, false, nil
+	}
+	return d.lookup.get(key)
+}
+
+func (d *diskTable) has(key int64) (bool, error) {
+	_, ok, err := d.get(key)
+	return ok, err
+}
+
+// 调用者保证写入的key不存在, 重放的时候可能覆盖内存里的key
+func (d *diskTable) set(key int64, index Index, pos int64) {
+	if e, found := d.memGet(key); !found || e.deleted {
+		d.live++
+	}
+	d.recent[key] = diskEntry{Index: index}
+}
+
+// 重放的时候可能删除不存在的key, 和mapTable一样不存在就什么都不做
+func (d *diskTable) delete(key int64) {
+	// 查找文件读不出来的时候不知道在不在, 记一条删除挡住它, 个数不变
+	ok, err := d.has(key)
+	if err == nil && !ok {
+		return
+	}
+	if ok {
+		d.live--
+	}
+
+	if d.lookup == nil && d.frozen == nil {
+		delete(d.recent, key)
+		return
+	}
+	d.recent[key] = diskEntry{deleted: true}
+}
+
+func (d *diskTable) len() int {
+	return d.live
+}
+
+func (d *diskTable) each(start int64, fn func(key int64, index Index) bool) error {
+	return d.iterate(start, false, fn)
+}
+
+// 内存里的变化排好序, 和按key排序的查找文件归并, 够limit条就停
+func (d *diskTable) ascend(start int64, limit int, keep func(index Index) bool) ([]compactItem, error) {
+	// 删除的也要留着, 用来挡住查找文件里的旧记录
+	var mem []int64
+	for n, m := range []map[int64]diskEntry{d.recent, d.frozen} {
+		for key := range m {
+			if key < start {
+				continue
+			}
+			if _, ok := d.recent[key]; ok && n > 0 {
+				continue
+			}
+			mem = append(mem, key)
+		}
+	}
+	sort.Slice(mem, func(a, b int) bool { return mem[a] < mem[b] })
+
+	var items []compactItem
+	full := func() bool {
+		return limit > 0 && len(items) >= limit
+	}
+	emit := func(key int64, index Index) {
+		if keep(index) {
+			items = append(items, compactItem{key: key, Index: index})
+		}
+	}
+	// 放进内存里最小的一条变化
+	pop := func() {
+		if e, _ := d.memGet(mem[0]); !e.deleted {
+			emit(mem[0], e.Index)
+		}
+		mem = mem[1:]
+	}
+
+	if d.lookup != nil {
+		err := d.lookup.iterate(start, func(key int64, index Index) error {
+			for len(mem) > 0 && mem[0] < key && !full() {
+				pop()
+			}
+			if full() {
+				return errStopIter
+			}
+
+			// 同一个key以内存里的为准
+			if len(mem) > 0 && mem[0] == key {
+				pop()
+			} else {
+				emit(key, index)
+			}
+
+			if full() {
+				return errStopIter
+			}
+			return nil
+		})
+		if err != nil && err != errStopIter {
+			return nil, err
+		}
+	}
+
+	// 查找文件读完了, 剩下的都在内存里
+	for len(mem) > 0 && !full() {
+		pop()
+	}
+	return items, nil
+}
+
+func (d *diskTable) eachTTL(fn func(key int64, index Index) bool) error {
+	return d.iterate(math.MinInt64, true, fn)
+}
+
+func (d *diskTable) iterate(start int64, ttl bool, fn func(key int64, index Index) bool) error {
+	for n, m := range []map[int64]diskEntry{d.recent, d.frozen} {
+		for key, e := range m {
+			if key < start || e.deleted || (ttl && e.Timeout == 0) {
+				continue
+			}
+
+			// frozen里的被recent覆盖了
+			if _, ok := d.recent[key]; ok && n > 0 {
+				continue
+			}
+			if !fn(key, e.Index) {
+				return nil
+			}
+		}
+	}
+
+	if d.lookup == nil {
+		return nil
+	}
+
+	visit := func(key int64, index Index) error {
+		if _, found := d.memGet(key); found {
+			return nil
+		}
+		if !fn(key, index) {
+			return errStopIter
+		}
+		return nil
+	}
+
+	var err error
+	if ttl {
+		err = d.lookup.iterateTTL(visit)
+	} else {
+		err = d.lookup.iterate(start, visit)
+	}
+	if err == errStopIter {
+		return nil
+	}
+	return err
+}
+
+func (d *diskTable) seal() {}
+
+func (d *diskTable) freeze() func(fn func(key int64, index *Index) error) error {
+	d.frozen, d.recent = d.recent, make(map[int64]diskEntry)
+	frozen, lookup := d.frozen, d.lookup
+
+	return func(fn func(key int64, index *Index) error) error {
+		keys := make([]int64, 0, len(frozen))
+		for key := range frozen {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+
+		j := 0
+		emit := func() error {
+			e := frozen[keys[j]]
+			j++
+			if e.deleted {
+				return nil
+			}
+			return fn(keys[j-1], &e.Index)
+		}
+
+		// 查找文件和frozen归并, 同一个key以frozen为准
+		if lookup != nil {
+			err := lookup.iterate(math.MinInt64, func(key int64, index Index) error {
+				for j < len(keys) && keys[j] < key {
+					if err := emit(); err != nil {
+						return err
+					}
+				}
+
+				if j < len(keys) && keys[j] == key {
+					return emit()
+				}
+				return fn(key, &index)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		for j < len(keys) {
+			if err := emit(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (d *diskTable) thaw(name string, ok bool) (err error) {
+	var lookup *lookupFile
+	if ok {
+		lookup, err = openLookupFile(name, d.cacheSize)
+	}
+
+	if !ok || err != nil {
+		// 没有写成功, frozen放回去, 新的变化优先
+		for key, e := range d.frozen {
+			if _, found := d.recent[key]; !found {
+				d.recent[key] = e
+			}
+		}
+		d.frozen = nil
+		return err
+	}
+
+	if d.lookup != nil {
+		d.lookup.close()
+	}
+	d.lookup, d.frozen = lookup, nil
+	return nil
+}
+
+func (d *diskTable) load(f *os.File, h *snapHeader) (err error) {
+	if d.lookup, err = newLookupFile(f, h, d.cacheSize); err != nil {
+		return err
+	}
+	d.live = int(h.count)
+	return nil
+}
+
+func (d *diskTable) dirty() bool {
+	return len(d.recent) >= minRecent || (d.lookup == nil && len(d.recent) > 0)
+}
+
+func (d *diskTable) Close() error {
+	if d.lookup == nil {
+		return nil
+	}
+	return d.lookup.close()
+}
+
+// 只读的查找文件, 格式和快照一样
+type lookupFile struct {
+	f     *os.File
+	h     snapHeader
+	ttl   []int64
+	cache *pageCache
+}
+
+func openLookupFile(name string, cacheSize Size) (*lookupFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var head [snapHeaderLen]byte
+	var h snapHeader
+	if _, err = f.ReadAt(head[:], 0); err == nil {
+		err = h.decode(head[:])
+	}
+
+	var l *lookupFile
+	if err == nil {
+		l, err = newLookupFile(f, &h, cacheSize)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func newLookupFile(f *os.File, h *snapHeader, cacheSize Size) (*lookupFile, error) {
+	ttl, err := readSnapTTL(f, h)
+	if err != nil {
+		return nil, err
+	}
+	return &lookupFile{f: f, h: *h, ttl: ttl, cache: newPageCache(int(cacheSize / snapPageSize))}, nil
+}
+
+func (l *lookupFile) close() error {
+	return l.f.Close()
+}
+
+// 读第p页, 先查缓存
+func (l *lookupFile) page(p int64) ([]byte, error) {
+	if buf, ok := l.cache.get(p); ok {
+		return buf, nil
+	}
+
+	buf := make([]byte, snapPageSize)
+	if _, err := l.f.ReadAt(buf, snapHeaderLen+p*snapPageSize); err != nil {
+		return nil, fmt.Errorf("%w:read page %d:%s", ErrBadData, p, err)
+	}
+
+	if err := checkSnapPage(buf, p); err != nil {
+		return nil, fmt.Errorf("%w:%s", ErrBadData, err)
+	}
+
+	l.cache.add(p, buf)
+	return buf, nil
+}
+
+// 页里第m条的key
+func pageKey(page []byte, m int) int64 {
+	return int64(binary.LittleEndian.Uint64(page[m*fixedRecordLen+4:]))
+}
+
+// 第p页的条目个数
+func (l *lookupFile) pageLen(p int64) int {
+	if n := l.h.count - p*snapPageEntries; n < snapPageEntries {
+		return int(n)
+	}
+	return snapPageEntries
+}
+
+// 返回第一个不小于key的条目的序号, 都比key小返回条目个数
+func (l *lookupFile) search(key int64) (n int64, err error) {
+	// 找第一个首key大于key的页, 要找的条目在它前一页
+	p := sort.Search(int(l.h.pages()), func(p int) bool {
+		if err != nil {
+			return true
+		}
+
+		page, e := l.page(int64(p))
+		if e != nil {
+			err = e
+			return true
+		}
+		return pageKey(page, 0) > key
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if p == 0 {
+		return 0, nil
+	}
+
+	page, err := l.page(int64(p - 1))
+	if err != nil {
+		return 0, err
+	}
+	m := sort.Search(l.pageLen(int64(p-1)), func(m int) bool {
+		return pageKey(page, m) >= key
+	})
+	return int64(p-1)*snapPageEntries + int64(m), nil
+}
+
+func (l *lookupFile) get(key int64) (index Index, ok bool, err error) {
+	n, err := l.search(key)
+	if err != nil || n >= l.h.count {
+		return index, false, err
+	}
+
+	page, err := l.page(n / snapPageEntries)
+	if err != nil {
+		return index, false, err
+	}
+
+	m := int(n % snapPageEntries)
+	if pageKey(page, m) != key {
+		return index, false, nil
+	}
+
+	_, index, err = decodeSnapEntry(page, m)
+	return index, err == nil, err
+}
+
+// 从start开始按key的顺序读, 顺序读不经过页缓存
+func (l *lookupFile) iterate(start int64, fn func(key int64, index Index) error) error {
+	n, err := l.search(start)
+	if err != nil {
+		return err
+	}
+
+	const chunk = 16
+	buf := make([]byte, chunk*snapPageSize)
+	for p := n / snapPageEntries; p < l.h.pages(); p += chunk {
+		count := l.h.pages() - p
+		if count > chunk {
+			count = chunk
+		}
+
+		pages := buf[:count*snapPageSize]
+		if _, err = l.f.ReadAt(pages, snapHeaderLen+p*snapPageSize); err != nil {
+			return fmt.Errorf("%w:read page %d:%s", ErrBadData, p, err)
+		}
+
+		for q := int64(0); q < count; q++ {
+			page := pages[q*snapPageSize : (q+1)*snapPageSize]
+			if err = checkSnapPage(page, p+q); err != nil {
+				return fmt.Errorf("%w:%s", ErrBadData, err)
+			}
+
+			m := 0
+			if p+q == n/snapPageEntries {
+				m = int(n % snapPageEntries)
+			}
+			for ; m < l.pageLen(p+q); m++ {
+				key, index, err := decodeSnapEntry(page, m)
+				if err != nil {
+					return fmt.Errorf("%w:%s", ErrBadData, err)
+				}
+				if err = fn(key, index); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// 遍历有过期时间的key
+func (l *lookupFile) iterateTTL(fn func(key int64, index Index) error) error {
+	for _, key := range l.ttl {
+		index, ok, err := l.get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err = fn(key, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LRU页缓存, 并发的Get持有读锁, 所以缓存自己加锁
+type pageCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	pages map[int64]*list.Element
+}
+
+type cachedPage struct {
+	n   int64
+	buf []byte
+}
+
+func newPageCache(max int) *pageCache {
+	if max < 1 {
+		max = 1
+	}
+	return &pageCache{max: max, ll: list.New(), pages: make(map[int64]*list.Element)}
+}
+
+// 返回的页只读, 淘汰之后也不会被复用
+func (c *pageCache) get(n int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.pages[n]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cachedPage).buf, true
+}
+
+func (c *pageCache) add(n int64, buf []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.pages[n]; ok {
+		c.ll.MoveToFront(e)
+		return
+	}
+
+	c.pages[n] = c.ll.PushFront(&cachedPage{n: n, buf: buf})
+	if c.ll.Len() > c.max {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.pages, last.Value.(*cachedPage).n)
+	}
+}
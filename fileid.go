@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 文件id的编码版本, 放在编码后的第一个字节
+const fileIDVersion1 = 1
+
+const maxGroupIndex = int(^uint32(0) >> 1)
+
+// 对外的文件id
+// 编码格式: 版本(1字节) + 组号(uvarint) + key(uvarint) + cookie(4字节大端, 为0时省略), 再用base64 url编码
+// 旧版本的"组,key"和"组,key,cookie"格式也能解析
+type FileID struct {
+	GroupIndex int
+	Key        int64
+	Cookie     uint32
+}
+
+// 编码成url安全的字符串
+func (f FileID) String() string {
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64*2+4)
+	buf = append(buf, fileIDVersion1)
+	buf = binary.AppendUvarint(buf, uint64(f.GroupIndex))
+	buf = binary.AppendUvarint(buf, uint64(f.Key))
+	if f.Cookie != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, f.Cookie)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// json里编码成字符串
+func (f FileID) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+func (f *FileID) UnmarshalText(text []byte) (err error) {
+	*f, err = ParseFileID(string(text))
+	return
+}
+
+// 解析文件id, base64编码里没有逗号, 有逗号的是旧格式
+func ParseFileID(s string) (f FileID, err error) {
+	if strings.Contains(s, ",") {
+		return parseLegacyFileID(s)
+	}
+
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return f, fmt.Errorf("%w %s", ErrIllegalKey, err)
+	}
+
+	if len(buf) == 0 || buf[0] != fileIDVersion1 {
+		return f, fmt.Errorf("%w unknown version", ErrIllegalKey)
+	}
+	buf = buf[1:]
+
+	groupIndex, n := binary.Uvarint(buf)
+	if n <= 0 || groupIndex > uint64(maxGroupIndex) {
+		return f, fmt.Errorf("%w bad group index", ErrIllegalKey)
+	}
+	buf = buf[n:]
+
+	key, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return f, fmt.Errorf("%w bad key", ErrIllegalKey)
+	}
+	buf = buf[n:]
+
+	f.GroupIndex, f.Key = int(groupIndex), int64(key)
+	switch len(buf) {
+	case 0:
+	case 4:
+		f.Cookie = binary.BigEndian.Uint32(buf)
+	default:
+		return FileID{}, fmt.Errorf("%w bad cookie", ErrIllegalKey)
+	}
+	return f, nil
+}
+
+// 旧格式"组,key"或者"组,key,cookie", cookie是16进制
+func parseLegacyFileID(s string) (f FileID, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 && len(parts) != 3 {
+		return f, ErrIllegalKey
+	}
+
+	if f.GroupIndex, err = strconv.Atoi(parts[0]); err != nil {
+		return FileID{}, fmt.Errorf("%w %s", ErrIllegalKey, err)
+	}
+
+	if f.Key, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return FileID{}, fmt.Errorf("%w %s", ErrIllegalKey, err)
+	}
+
+	if len(parts) == 3 {
+		var c uint64
+		if c, err = strconv.ParseUint(parts[2], 16, 32); err != nil {
+			return FileID{}, fmt.Errorf("%w %s", ErrIllegalKey, err)
+		}
+		f.Cookie = uint32(c)
+	}
+	return f, nil
+}
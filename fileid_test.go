@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 编码之后能解析回来, 旧格式也能解析
+func Test_FileID(t *testing.T) {
+	for _, id := range []FileID{
+		{},
+		{GroupIndex: 1, Key: 10, Cookie: 0x1234abcd},
+		{GroupIndex: 3, Key: 1 << 40},
+		{GroupIndex: 0, Key: -1, Cookie: 1},
+	} {
+		s := id.String()
+		assert.NotContains(t, s, ",")
+		id2, err := ParseFileID(s)
+		assert.NoError(t, err)
+		assert.Equal(t, id2, id)
+	}
+
+	id, err := ParseFileID("1,10,1234abcd")
+	assert.NoError(t, err)
+	assert.Equal(t, id, FileID{GroupIndex: 1, Key: 10, Cookie: 0x1234abcd})
+
+	id, err = ParseFileID("1,10")
+	assert.NoError(t, err)
+	assert.Equal(t, id, FileID{GroupIndex: 1, Key: 10})
+
+	for _, s := range []string{"", "1", "1,10,zz", "1,10,1,1", "AA", "AQE", "AQEBAQ", "!!"} {
+		_, err = ParseFileID(s)
+		assert.ErrorIs(t, err, ErrIllegalKey, s)
+	}
+}
+
+// 组号超出范围
+func Test_CheckIndex(t *testing.T) {
+	g := &Group{datArr: make([]Storager, 2)}
+
+	_, err := g.checkIndex(FileID{GroupIndex: 1, Key: 10}.String())
+	assert.NoError(t, err)
+
+	_, err = g.checkIndex("2,10,1234abcd")
+	assert.ErrorIs(t, err, ErrIllegalKey)
+}
+
+func Benchmark_ParseFileID(b *testing.B) {
+	s := FileID{GroupIndex: 1, Key: 123456, Cookie: 0x1234abcd}.String()
+	for i := 0; i < b.N; i++ {
+		ParseFileID(s)
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/guonaihong/gout v0.3.1
 	github.com/guonaihong/gutil v0.0.1
 	github.com/stretchr/testify v1.7.1
+	golang.org/x/sys v0.0.0-20210806184541-e5e7981a1069
 	google.golang.org/protobuf v1.28.1
 )
 
@@ -31,7 +32,6 @@ require (
 	github.com/ugorji/go/codec v1.2.7 // indirect
 	golang.org/x/crypto v0.0.0-20211215153901-e495a2d5b3d3 // indirect
 	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2 // indirect
-	golang.org/x/sys v0.0.0-20210806184541-e5e7981a1069 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
@@ -1,12 +1,19 @@
 package storage
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
 	"os"
-	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Size int64
@@ -21,12 +28,36 @@ const (
 var (
 	ErrIllegalKey = errors.New("Illegal key")
 	ErrDirName    = errors.New("dir name is empty")
+	// key里的cookie和保存的不一致
+	ErrCookieMismatch = errors.New("cookie mismatch")
+	// 存储引擎都写满了, 个数也到了Max的限制
+	ErrNoSpace = errors.New("no space left in group")
+	// 组目录里序号中间的存储引擎没有了
+	ErrMissingSegment = errors.New("missing segment")
 )
 
-// 一组里面有多个引擎，一个引擎只存储32GB
+// 一组里面有多个引擎，一个引擎最多存储Options.SegmentSize, 默认32GB
+// 存储引擎在写满之后才新建, 个数不超过Max/SegmentSize, Max可以在运行时调整
+// 同时有Options.ActiveSegments个存储引擎可写, 按Options.Placement分配写入,
+// 一个写满了就换成下一个序号的存储引擎, 压缩回收了空间之后再换回来
 type Group struct {
-	datArr []Storager //一个组下面有多个存储引擎
-	next   int32
+	mu      sync.RWMutex
+	datArr  []Storager //一个组下面有多个存储引擎, 只增不减, mu保护
+	limit   int        //存储引擎个数的上限, mu保护
+	active  []int      //可写的存储引擎的序号, mu保护
+	nextNew int        //下一个变成可写的序号, mu保护
+	reclaim []int      //写满之后压缩又有了空间的序号, 等着重新变成可写, mu保护
+	rr      uint32     //轮流写的计数
+	keyMu   sync.Mutex //指定key的写入串行执行
+	nextKey int64      //自动分配的key不小于这个值, 比调用者指定过的key都大, mu保护
+
+	dir     string
+	factory BackendFactory
+
+	opt        Options
+	stopReaper func()     //停止后台删除过期数据
+	home       groupDir   //组目录, 保存目录锁, 名字索引和桶的配置
+	names      *nameIndex //名字索引, 没有打开时为nil
 }
 
 func dirName(dir string) string {
@@ -37,118 +68,716 @@ func dirName(dir string) string {
 }
 
 // 加载
-func loadOrNewGroup(dir string, max Size) (g *Group, err error) {
+func loadOrNewGroup(dir string, opt *Options) (g *Group, err error) {
 	// 检查dir否为空, 如果返回错误
 	if len(dir) == 0 {
 		return nil, ErrDirName
 	}
 
-	// 检查目录是否存在
-	_, err = os.Stat(dir)
-	if os.IsNotExist(err) {
-		// 不存在新建一个
-		os.Mkdir(dir, 0755)
-	}
-
-	// 一个dat最多到32GB，计算可以创建多少个
-	count := max / maxDatLimit
-	if count == 0 {
-		count = 1
-	}
-
-	g = &Group{}
-	g.datArr = make([]Storager, count)
+	g = &Group{opt: *opt, dir: dirName(dir), limit: segmentLimit(opt.Max, opt.SegmentSize)}
 
 	defer func() {
 		if err != nil {
 			g.Close()
 		}
 	}()
-	for i := range g.datArr {
-		var idx *IndexInMemory
-		idx, err = newIndexInMemory(fmt.Sprintf("%s%d", dirName(dir), i))
+
+	b, err := lookupBackend(opt.Backend)
+	if err != nil {
+		return
+	}
+	g.factory = b.factory
+
+	// 写进程打开时加目录锁, 之后才能恢复和修改文件
+	if g.home, err = b.openDir(dir, opt); err != nil {
+		return
+	}
+
+	// 按已经有的存储引擎加载, 超过limit的也要加载, 不然上面的数据读不到
+	count, err := g.home.segments()
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		var s Storager
+		s, err = g.factory(g.segmentName(i), opt)
 		if err != nil {
+			// 只读打开时, 写进程还没有创建的存储引擎就不加载了
+			if opt.ReadOnly && errors.Is(err, os.ErrNotExist) {
+				err = nil
+				break
+			}
+			return
+		}
+		g.datArr = append(g.datArr, s)
+
+		// 只读打开时尾部不完整的记录可能是写进程正在写的, 不用报告
+		if r, ok := s.(Recoverer); ok && !opt.ReadOnly {
+			if report := r.Recovery(); report.Recovered() {
+				opt.Logger.Printf("%s", report)
+			}
+		}
+	}
+
+	g.fillActive()
+	g.skipKeys(0)
+
+	if opt.NameIndex {
+		if g.names, err = openNameIndex(g.home, opt); err != nil {
 			return
 		}
-		g.datArr[i] = idx
 	}
 
+	if !opt.ReadOnly {
+		g.stopReaper = g.startReaper(opt.ReapInterval)
+	}
 	return
 }
 
 func (g *Group) Put(data []byte) (index string, err error) {
+	return g.PutWithTTL(data, 0)
+}
+
+// 保存, 超过ttl之后get不到, ttl为0表示永不过期
+func (g *Group) PutWithTTL(data []byte, ttl time.Duration) (index string, err error) {
+	return g.PutReaderWithTTL(bytes.NewReader(data), int64(len(data)), ttl)
+}
+
+// 流式保存, 从r读取size个字节
+func (g *Group) PutReader(r io.Reader, size int64) (index string, err error) {
+	return g.PutReaderWithTTL(r, size, 0)
+}
+
+// 流式保存, 超过ttl之后get不到, ttl为0表示永不过期
+func (g *Group) PutReaderWithTTL(r io.Reader, size int64, ttl time.Duration) (index string, err error) {
+	return g.PutReaderWithOptions(r, size, PutOptions{TTL: ttl})
+}
 
-	groupIndex := atomic.LoadInt32(&g.next)
-	key := int64(0)
-	for groupIndex < int32(len(g.datArr)) {
-		groupIndex = atomic.LoadInt32(&g.next)
-		key = g.datArr[groupIndex].GetSeq()
-		err = g.datArr[groupIndex].Put(key, data)
+// 流式保存, 可以设置过期时间和元数据, opt.Cookie会被忽略, 由组生成
+func (g *Group) PutReaderWithOptions(r io.Reader, size int64, opt PutOptions) (index string, err error) {
+	id, err := g.putReader(0, false, r, size, opt)
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// 用调用者自己的key保存, 比如雪花算法生成的id, key在组里已经存在返回ErrKeyExists
+func (g *Group) PutWithKey(key int64, data []byte) (index string, err error) {
+	return g.PutReaderWithKey(key, bytes.NewReader(data), int64(len(data)), 0)
+}
+
+// 用调用者自己的key流式保存, ttl为0表示永不过期
+func (g *Group) PutReaderWithKey(key int64, r io.Reader, size int64, ttl time.Duration) (index string, err error) {
+	// 不同的存储引擎不知道对方有哪些key, 指定key的写入串行执行, 检查和写入都持有keyMu
+	g.keyMu.Lock()
+	defer g.keyMu.Unlock()
+
+	// 先让所有的存储引擎自动分配的key跳过它, 之后再检查, 检查完不会有别的写入用到这个key
+	if key >= 0 && key < math.MaxInt64 {
+		g.skipKeys(key + 1)
+	}
+
+	for _, s := range g.segments() {
+		ok, err := hasKey(s, key)
 		if err != nil {
-			if errors.Is(err, ErrFull) {
-				// 只有一个go程可以安全修改
-				atomic.CompareAndSwapInt32(&g.next, groupIndex, groupIndex+1)
-				continue
+			return "", err
+		}
+		if ok {
+			return "", fmt.Errorf("%w:key(%d)", ErrKeyExists, key)
+		}
+	}
+
+	id, err := g.putReader(key, true, r, size, PutOptions{TTL: ttl})
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+// key是否已经被占用, 存储引擎没有实现KeyChecker时用Stat
+func hasKey(s Storager, key int64) (bool, error) {
+	if c, ok := s.(KeyChecker); ok {
+		return c.HasKey(key)
+	}
+	_, ok, err := s.Stat(key)
+	return ok, err
+}
+
+// 所有的存储引擎之后自动分配的key都不小于next, 也不小于别的存储引擎下一个自动分配的key,
+// 所以自动分配的key不会和别的存储引擎里调用者指定的key重复, 重启之后也一样
+func (g *Group) skipKeys(next int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if next > g.nextKey {
+		g.nextKey = next
+	}
+	for _, s := range g.datArr {
+		if c, ok := s.(KeyChecker); ok && c.NextKey() > g.nextKey {
+			g.nextKey = c.NextKey()
+		}
+	}
+	for _, s := range g.datArr {
+		if c, ok := s.(KeyChecker); ok {
+			c.SkipKeys(g.nextKey)
+		}
+	}
+}
+
+// 一个dat最多到SegmentSize，计算可以创建多少个
+func segmentLimit(max, segmentSize Size) int {
+	if count := int(max / segmentSize); count > 0 {
+		return count
+	}
+	return 1
+}
+
+func (g *Group) segmentName(n int) string {
+	return fmt.Sprintf("%s%d", g.dir, n)
+}
+
+// 第n个存储引擎, 还没有新建返回false
+func (g *Group) segment(n int) (Storager, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if n >= len(g.datArr) {
+		return nil, false
+	}
+	return g.datArr[n], true
+}
+
+// 所有存储引擎的快照
+func (g *Group) segments() []Storager {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.datArr[:len(g.datArr):len(g.datArr)]
+}
+
+// 返回第n个存储引擎, 还没有新建的时候把到n为止的都新建出来, 超过上限返回ErrNoSpace
+func (g *Group) writable(n int) (Storager, error) {
+	if s, ok := g.segment(n); ok {
+		return s, nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if n >= g.limit && n >= len(g.datArr) {
+		return nil, fmt.Errorf("%w:%d segments, max(%d)", ErrNoSpace, len(g.datArr), g.opt.Max)
+	}
+
+	// 别的go程可能已经新建了
+	for len(g.datArr) <= n {
+		s, err := g.factory(g.segmentName(len(g.datArr)), &g.opt)
+		if err != nil {
+			return nil, err
+		}
+		if c, ok := s.(KeyChecker); ok {
+			c.SkipKeys(g.nextKey)
+		}
+		g.datArr = append(g.datArr, s)
+	}
+	return g.datArr[n], nil
+}
+
+// 可写的存储引擎补到ActiveSegments个, 需要持有写锁
+func (g *Group) fillActive() {
+	for len(g.active) < g.opt.ActiveSegments {
+		n, ok := g.nextWritable()
+		if !ok {
+			return
+		}
+		g.active = append(g.active, n)
+	}
+}
+
+// 下一个变成可写的序号, 先用压缩回收了空间的, 再用已经有的存储引擎和上限以内的序号, 需要持有写锁
+func (g *Group) nextWritable() (int, bool) {
+	if len(g.reclaim) > 0 {
+		n := g.reclaim[0]
+		g.reclaim = g.reclaim[1:]
+		return n, true
+	}
+
+	if g.nextNew < len(g.datArr) || g.nextNew < g.limit {
+		g.nextNew++
+		return g.nextNew - 1, true
+	}
+	return 0, false
+}
+
+// 按写入分配策略选一个可写的存储引擎, 都写满了返回ErrNoSpace
+func (g *Group) pick(hint string) (int, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if len(g.active) == 0 {
+		return 0, fmt.Errorf("%w:%d segments, max(%d)", ErrNoSpace, len(g.datArr), g.opt.Max)
+	}
+
+	switch {
+	case g.opt.Placement == PlaceLeastFull:
+		best, min := 0, int64(math.MaxInt64)
+		for pos, n := range g.active {
+			// 还没有新建的算作空的
+			used := int64(0)
+			if n < len(g.datArr) {
+				if s, ok := g.datArr[n].(Sizer); ok {
+					used = s.UsedSize()
+				}
 			}
 
-			if err != nil {
-				return
+			if used < min {
+				best, min = pos, used
 			}
 		}
-		break
+		return g.active[best], nil
+
+	case g.opt.Placement == PlaceHash && hint != "":
+		h := fnv.New32a()
+		h.Write([]byte(hint))
+		return g.active[h.Sum32()%uint32(len(g.active))], nil
 	}
 
-	return fmt.Sprintf("%d,%d", groupIndex, key), nil
+	rr := atomic.AddUint32(&g.rr, 1) - 1
+	return g.active[rr%uint32(len(g.active))], nil
 }
 
-func (g *Group) checkIndex(key string) (groupIndex int, idx int, err error) {
+// 第n个存储引擎不能再写了, 换成下一个序号, 没有下一个就从可写的里面去掉
+func (g *Group) retire(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 
-	pos := strings.Index(key, ",")
-	if pos == -1 {
-		err = ErrIllegalKey
+	for pos, m := range g.active {
+		// 别的go程已经换掉了
+		if m != n {
+			continue
+		}
+
+		if next, ok := g.nextWritable(); ok {
+			// 换在原来的位置, 按hint分配的写入还是去同一个位置
+			g.active[pos] = next
+		} else {
+			g.active = append(g.active[:pos], g.active[pos+1:]...)
+		}
 		return
 	}
+}
+
+// 调整组的最大容量, 之后的写入按新的容量新建存储引擎
+// 已经有的存储引擎不会删除, 容量调小之后只是不再新建
+func (g *Group) SetMax(max Size) error {
+	if g.opt.ReadOnly {
+		return ErrReadOnly
+	}
 
-	groupIndexStr := key[:pos]
-	groupIndex, err = strconv.Atoi(groupIndexStr)
+	if max < 0 {
+		return &OptionError{Field: "Max", Value: max, Reason: "must not be negative"}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.opt.Max = max
+	g.limit = segmentLimit(max, g.opt.SegmentSize)
+	g.fillActive()
+	return nil
+}
+
+// 组的最大容量
+func (g *Group) Max() Size {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.opt.Max
+}
+
+// withKey为false时由存储引擎分配key
+func (g *Group) putReader(key int64, withKey bool, r io.Reader, size int64, opt PutOptions) (id FileID, err error) {
+	if g.opt.ReadOnly {
+		return id, ErrReadOnly
+	}
+
+	cookie, err := newCookie()
 	if err != nil {
-		err = fmt.Errorf("%w %s", ErrIllegalKey, err)
+		return id, err
+	}
+
+	opt.Cookie = cookie
+	for {
+		groupIndex, err := g.pick(opt.Hint)
+		if err != nil {
+			return id, err
+		}
+
+		// 容量调小了, 还没有新建的不能再建
+		s, err := g.writable(groupIndex)
+		if errors.Is(err, ErrNoSpace) {
+			g.retire(groupIndex)
+			continue
+		}
+		if err != nil {
+			return id, err
+		}
+
+		if withKey {
+			err = s.PutReaderWithKey(key, r, size, opt)
+		} else {
+			key, err = s.PutReader(r, size, opt)
+		}
+
+		// 空间满了是在读r之前返回的, 可以换一个存储引擎重试
+		if errors.Is(err, ErrFull) {
+			g.retire(groupIndex)
+			continue
+		}
+
+		if err != nil {
+			return id, err
+		}
+		return FileID{GroupIndex: groupIndex, Key: key, Cookie: cookie}, nil
+	}
+}
+
+// 生成不为0的随机cookie, 0留给没有cookie的旧数据
+func newCookie() (cookie uint32, err error) {
+	var buf [4]byte
+	for cookie == 0 {
+		if _, err = rand.Read(buf[:]); err != nil {
+			return 0, err
+		}
+		cookie = binary.LittleEndian.Uint32(buf[:])
+	}
+	return cookie, nil
+}
+
+// 解析key并检查组号
+func (g *Group) checkIndex(key string) (id FileID, err error) {
+	if id, err = ParseFileID(key); err != nil {
 		return
 	}
+	return id, g.checkID(id)
+}
+
+func (g *Group) checkID(id FileID) error {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	// 还没有新建的存储引擎里什么都没有, 不算非法
+	if id.GroupIndex < 0 || (id.GroupIndex >= len(g.datArr) && id.GroupIndex >= g.limit) {
+		return fmt.Errorf("%w, groupIndex:%d > len(g.datArr:%d)", ErrIllegalKey, id.GroupIndex, len(g.datArr))
+	}
+	return nil
+}
 
-	idxStr := key[pos+1:]
-	idx, err = strconv.Atoi(idxStr)
+func (g *Group) Get(key string) (element Data, ok bool, err error) {
+	id, err := g.checkIndex(key)
 	if err != nil {
-		err = fmt.Errorf("%w %s", ErrIllegalKey, err)
 		return
 	}
+	return g.getByID(id)
+}
 
-	if groupIndex >= len(g.datArr) {
-		err = fmt.Errorf("%w, groupIndex:%d > len(g.datArr:%d)", ErrIllegalKey, groupIndex, len(g.datArr))
+// 和Get一样, 不用再解析字符串
+func (g *Group) GetByID(id FileID) (element Data, ok bool, err error) {
+	if err = g.checkID(id); err != nil {
 		return
 	}
+	return g.getByID(id)
+}
+
+func (g *Group) getByID(id FileID) (element Data, ok bool, err error) {
+	s, ok := g.segment(id.GroupIndex)
+	if !ok {
+		return
+	}
+
+	element, ok, err = s.Get(id.Key)
+	if ok && element.Cookie != id.Cookie {
+		return Data{}, false, ErrCookieMismatch
+	}
 	return
 }
 
-func (g *Group) Get(key string) (element Data, ok bool, err error) {
-	groupIndex, idx, err := g.checkIndex(key)
+// 读取[offset, offset+length)范围内的数据, length小于0表示读到结尾
+func (g *Group) GetRange(key string, offset, length int64) (element Data, ok bool, err error) {
+	id, err := g.checkIndex(key)
 	if err != nil {
 		return
 	}
-	return g.datArr[groupIndex].Get(int64(idx))
+	return g.getRangeByID(id, offset, length)
+}
+
+// 和GetRange一样, 不用再解析字符串
+func (g *Group) GetRangeByID(id FileID, offset, length int64) (element Data, ok bool, err error) {
+	if err = g.checkID(id); err != nil {
+		return
+	}
+	return g.getRangeByID(id, offset, length)
+}
+
+func (g *Group) getRangeByID(id FileID, offset, length int64) (element Data, ok bool, err error) {
+	// 先检查cookie, 不匹配时不要暴露对象大小
+	if ok, err = g.stat(id); err != nil || !ok {
+		return
+	}
+	s, _ := g.segment(id.GroupIndex)
+	return s.GetRange(id.Key, offset, length)
+}
+
+// 打开一个对象用于流式读取, 用完需要Close
+func (g *Group) OpenObject(key string) (obj *Object, ok bool, err error) {
+	id, err := g.checkIndex(key)
+	if err != nil {
+		return
+	}
+	return g.openObjectByID(id)
+}
+
+// 和OpenObject一样, 不用再解析字符串
+func (g *Group) OpenObjectByID(id FileID) (obj *Object, ok bool, err error) {
+	if err = g.checkID(id); err != nil {
+		return
+	}
+	return g.openObjectByID(id)
+}
+
+func (g *Group) openObjectByID(id FileID) (obj *Object, ok bool, err error) {
+	s, ok := g.segment(id.GroupIndex)
+	if !ok {
+		return
+	}
+
+	obj, ok, err = s.OpenObject(id.Key)
+	if ok && obj.Cookie != id.Cookie {
+		obj.Close()
+		return nil, false, ErrCookieMismatch
+	}
+	return
+}
+
+// 检查cookie, 不存在返回ok为false
+func (g *Group) stat(id FileID) (ok bool, err error) {
+	s, ok := g.segment(id.GroupIndex)
+	if !ok {
+		return
+	}
+
+	index, ok, err := s.Stat(id.Key)
+	if err != nil || !ok {
+		return
+	}
+
+	if index.Cookie != id.Cookie {
+		return false, ErrCookieMismatch
+	}
+	return true, nil
 }
 
 func (g *Group) Delete(key string) (err error) {
-	groupIndex, idx, err := g.checkIndex(key)
+	id, err := g.checkIndex(key)
 	if err != nil {
 		return
 	}
-	return g.datArr[groupIndex].Delete(int64(idx))
+	return g.deleteByID(id)
+}
+
+// 和Delete一样, 不用再解析字符串
+func (g *Group) DeleteByID(id FileID) (err error) {
+	if err = g.checkID(id); err != nil {
+		return
+	}
+	return g.deleteByID(id)
+}
+
+func (g *Group) deleteByID(id FileID) (err error) {
+	if g.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	ok, err := g.stat(id)
+	if err != nil || !ok {
+		return
+	}
+	s, _ := g.segment(id.GroupIndex)
+	return s.Delete(id.Key)
+}
+
+// 压缩垃圾率大于等于ratio的存储引擎, ratio为0时压缩所有的存储引擎
+// 写满之后换掉的存储引擎压缩完重新变成可写
+func (g *Group) Compact(ratio float64) (err error) {
+	for n, s := range g.segments() {
+		c, ok := s.(Compacter)
+		if !ok {
+			continue
+		}
+
+		if c.GarbageRatio() < ratio {
+			continue
+		}
+
+		if err = c.Compact(); err != nil {
+			if errors.Is(err, ErrCompacting) || errors.Is(err, ErrInUse) {
+				continue
+			}
+			return err
+		}
+		g.reopen(n)
+	}
+	return nil
+}
+
+// 第n个存储引擎压缩过了, 写满换掉了的话放回去等着重新变成可写
+// 压缩之后还是满的, 写入时返回ErrFull再换掉
+func (g *Group) reopen(n int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// 还没有轮到的存储引擎本来就会变成可写
+	if n >= g.nextNew {
+		return
+	}
+
+	for _, m := range g.active {
+		if m == n {
+			return
+		}
+	}
+	for _, m := range g.reclaim {
+		if m == n {
+			return
+		}
+	}
+
+	g.reclaim = append(g.reclaim, n)
+	g.fillActive()
+}
+
+// 每隔interval检查一次垃圾率, 大于等于ratio就压缩, 调用返回的函数停止
+func (g *Group) AutoCompact(ratio float64, interval time.Duration) (stop func()) {
+	return runEvery(interval, func(time.Time) {
+		if err := g.Compact(ratio); err != nil {
+			g.opt.Logger.Printf("compact:%s", err)
+		}
+	})
+}
+
+// 返回启动时做过恢复的存储引擎的恢复报告
+func (g *Group) Recovered() (reports []RecoveryReport) {
+	for _, s := range g.segments() {
+		r, ok := s.(Recoverer)
+		if !ok {
+			continue
+		}
+
+		if report := r.Recovery(); report.Recovered() {
+			reports = append(reports, report)
+		}
+	}
+	return
+}
+
+// 把所有存储引擎里过期的数据转成删除
+func (g *Group) Expire(now time.Time) (n int, err error) {
+	for _, s := range g.segments() {
+		e, ok := s.(Expirer)
+		if !ok {
+			continue
+		}
+
+		count, err := e.Expire(now)
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// 后台定时删除过期数据
+func (g *Group) startReaper(interval time.Duration) (stop func()) {
+	return runEvery(interval, func(now time.Time) {
+		if _, err := g.Expire(now); err != nil {
+			g.opt.Logger.Printf("expire:%s", err)
+		}
+	})
+}
+
+// 起一个go程每隔interval调用一次fn, 调用返回的函数停止
+func runEvery(interval time.Duration, fn func(now time.Time)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		tk := time.NewTicker(interval)
+		defer tk.Stop()
+		for {
+			select {
+			case now := <-tk.C:
+				fn(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// 关闭马上要删除的组, 存储引擎不写快照, 名字索引不压缩, 出错了也接着关闭
+func (g *Group) discard() (err error) {
+	if g.stopReaper != nil {
+		g.stopReaper()
+	}
+
+	if g.home != nil {
+		defer func() {
+			g.home.close()
+			g.home = nil
+		}()
+	}
+
+	if g.names != nil {
+		err = g.names.discard()
+	}
+
+	for _, s := range g.segments() {
+		var e error
+		if d, ok := s.(Discarder); ok {
+			e = d.Discard()
+		} else {
+			e = s.Close()
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
 
 // 关闭所有索引
 func (g *Group) Close() (err error) {
-	for _, s := range g.datArr {
+	if g.stopReaper != nil {
+		g.stopReaper()
+	}
+
+	if g.home != nil {
+		defer func() {
+			g.home.close()
+			g.home = nil
+		}()
+	}
+
+	if g.names != nil {
+		if err = g.names.close(); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range g.segments() {
 		if s == nil {
 			continue
 		}
@@ -0,0 +1,362 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 组的测试在两种后端上各跑一遍
+func testBackends(t *testing.T, fn func(t *testing.T, backend string)) {
+	for _, backend := range []string{BackendFile, BackendMemory} {
+		t.Run(backend, func(t *testing.T) {
+			fn(t, backend)
+		})
+	}
+}
+
+// 写入返回的index能读到自己的数据, cookie不对读不到
+func Test_GroupPutGet(t *testing.T) {
+	testBackends(t, testGroupPutGet)
+}
+
+func testGroupPutGet(t *testing.T, backend string) {
+	dir := "./testdata/group_" + backend
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: GB, Backend: backend})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var ids []string
+	for _, data := range []string{"hello", "world"} {
+		id, err := s.Put([]byte(data))
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	for n, data := range []string{"hello", "world"} {
+		elem, ok, err := s.Get(ids[n])
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, string(elem.Data), data)
+	}
+
+	id, err := ParseFileID(ids[0])
+	assert.NoError(t, err)
+	id.Cookie++
+	_, _, err = s.GetByID(id)
+	assert.ErrorIs(t, err, ErrCookieMismatch)
+	assert.ErrorIs(t, s.DeleteByID(id), ErrCookieMismatch)
+}
+
+// 指定key写入, 重复使用返回ErrKeyExists
+func Test_GroupPutWithKey(t *testing.T) {
+	testBackends(t, testGroupPutWithKey)
+}
+
+func testGroupPutWithKey(t *testing.T, backend string) {
+	dir := "./testdata/group_key_" + backend
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: GB, Backend: backend})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	index, err := s.PutWithKey(1234567890123, []byte("hello"))
+	assert.NoError(t, err)
+
+	_, err = s.PutWithKey(1234567890123, []byte("world"))
+	assert.ErrorIs(t, err, ErrKeyExists)
+
+	elem, ok, err := s.Get(index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+}
+
+// 多个存储引擎可写时, 指定的key在所有存储引擎里唯一, 过期了还没有删除的也算,
+// 自动分配的key不会和别的存储引擎里指定的key重复, 重启之后也一样
+func Test_GroupKeyAcrossSegments(t *testing.T) {
+	testBackends(t, testGroupKeyAcrossSegments)
+}
+
+func testGroupKeyAcrossSegments(t *testing.T, backend string) {
+	dir := "./testdata/group_key_segments_" + backend
+	os.RemoveAll(dir)
+
+	opt := Options{Max: GB, SegmentSize: MB, ActiveSegments: 2, Backend: backend}
+	s, err := OpenWithOptions(dir, opt)
+	assert.NoError(t, err)
+
+	_, err = s.PutReaderWithKey(10, bytes.NewReader([]byte("expired")), 7, time.Nanosecond)
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	// 轮流写, 两个存储引擎都会轮到
+	for n := 0; n < 4; n++ {
+		_, err = s.PutWithKey(10, []byte("again"))
+		assert.ErrorIs(t, err, ErrKeyExists)
+	}
+
+	chosen := map[int64]bool{10: true}
+	for key := int64(20); key < 24; key++ {
+		_, err = s.PutWithKey(key, []byte("chosen"))
+		assert.NoError(t, err)
+		chosen[key] = true
+	}
+
+	check := func(s Storage) {
+		for n := 0; n < 10; n++ {
+			index, err := s.Put([]byte("auto"))
+			assert.NoError(t, err)
+			id, err := ParseFileID(index)
+			assert.NoError(t, err)
+			assert.False(t, chosen[id.Key], "auto key %d", id.Key)
+		}
+	}
+	check(s)
+	assert.NoError(t, s.Close())
+
+	// 内存后端关闭之后数据就没有了
+	if backend == BackendMemory {
+		return
+	}
+
+	s, err = OpenWithOptions(dir, opt)
+	assert.NoError(t, err)
+	defer s.Close()
+	check(s)
+}
+
+// 存储引擎写满之后才新建, 到了上限返回ErrNoSpace, 调大容量之后可以继续写,
+// 重启时按目录里的文件加载, 容量调小了已经有的存储引擎还能读写
+func Test_GroupGrow(t *testing.T) {
+	dir := "./testdata/group_grow"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 2 * MB, SegmentSize: MB})
+	assert.NoError(t, err)
+
+	big := bytes.Repeat([]byte("x"), int(MB))
+	for n := 0; n < 2; n++ {
+		_, err = s.Put(big)
+		assert.NoError(t, err)
+		assert.Len(t, s.segments(), n+1)
+	}
+
+	_, err = s.Put([]byte("hello"))
+	assert.ErrorIs(t, err, ErrNoSpace)
+
+	assert.NoError(t, s.SetMax(3*MB))
+	assert.Equal(t, s.Max(), 3*MB)
+	index, err := s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	id, err := ParseFileID(index)
+	assert.NoError(t, err)
+	assert.Equal(t, id.GroupIndex, 2)
+	assert.NoError(t, s.Close())
+
+	s, err = OpenWithOptions(dir, Options{Max: MB, SegmentSize: MB})
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Len(t, s.segments(), 3)
+
+	elem, ok, err := s.Get(index)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+
+	// 已经有的存储引擎没写满还可以写
+	index, err = s.Put([]byte("world"))
+	assert.NoError(t, err)
+	id, err = ParseFileID(index)
+	assert.NoError(t, err)
+	assert.Equal(t, id.GroupIndex, 2)
+}
+
+// 写满之后删除再压缩, 不用重新打开就能接着写
+func Test_GroupCompactReclaim(t *testing.T) {
+	testBackends(t, testGroupCompactReclaim)
+}
+
+func testGroupCompactReclaim(t *testing.T, backend string) {
+	dir := "./testdata/group_reclaim_" + backend
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: MB, SegmentSize: MB, Backend: backend})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("x"), int(64*KB))
+	var ids []string
+	for {
+		id, err := s.Put(data)
+		if err != nil {
+			assert.ErrorIs(t, err, ErrNoSpace)
+			break
+		}
+		ids = append(ids, id)
+	}
+	assert.NotEmpty(t, ids)
+
+	for _, id := range ids {
+		assert.NoError(t, s.Delete(id))
+	}
+	assert.NoError(t, s.Compact(0))
+
+	id, err := s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	elem, ok, err := s.Get(id)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+}
+
+// 序号中间的存储引擎被删掉了, 打开失败, 不能复用这个序号
+func Test_GroupMissingSegment(t *testing.T) {
+	dir := "./testdata/group_missing"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 3 * MB, SegmentSize: MB})
+	assert.NoError(t, err)
+	for n := 0; n < 3; n++ {
+		_, err = s.Put(bytes.Repeat([]byte("x"), int(MB)))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, s.Close())
+
+	files, err := filepath.Glob(dir + "/1.*")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, files)
+	for _, f := range files {
+		assert.NoError(t, os.Remove(f))
+	}
+
+	_, err = OpenWithOptions(dir, Options{Max: 3 * MB, SegmentSize: MB})
+	assert.ErrorIs(t, err, ErrMissingSegment)
+}
+
+// 多个可写的存储引擎按策略分配写入, 写满的换成下一个, 都满了返回ErrNoSpace
+func Test_GroupPlacement(t *testing.T) {
+	open := func(name string, opt Options) Storage {
+		dir := "./testdata/placement_" + name
+		os.RemoveAll(dir)
+		opt.Backend = BackendMemory
+		s, err := OpenWithOptions(dir, opt)
+		assert.NoError(t, err)
+		return s
+	}
+
+	put := func(s Storage, size int, hint string) int {
+		index, err := s.PutReaderWithOptions(bytes.NewReader(make([]byte, size)), int64(size), PutOptions{Hint: hint})
+		assert.NoError(t, err)
+		id, err := ParseFileID(index)
+		assert.NoError(t, err)
+		return id.GroupIndex
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		s := open("rr", Options{Max: 3 * MB, SegmentSize: MB, ActiveSegments: 2})
+		defer s.Close()
+
+		assert.Equal(t, put(s, int(MB), ""), 0)
+		assert.Equal(t, put(s, int(MB), ""), 1)
+		// 0满了换成2, 1满了没有下一个
+		assert.Equal(t, put(s, int(MB), ""), 2)
+		_, err := s.Put([]byte("hello"))
+		assert.ErrorIs(t, err, ErrNoSpace)
+	})
+
+	t.Run("least-full", func(t *testing.T) {
+		s := open("least", Options{Max: 3 * MB, SegmentSize: MB, ActiveSegments: 3, Placement: PlaceLeastFull})
+		defer s.Close()
+
+		assert.Equal(t, put(s, 100, ""), 0)
+		assert.Equal(t, put(s, 300, ""), 1)
+		assert.Equal(t, put(s, 200, ""), 2)
+		assert.Equal(t, put(s, 1, ""), 0)
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		s := open("hash", Options{Max: 4 * MB, SegmentSize: MB, ActiveSegments: 4, Placement: PlaceHash})
+		defer s.Close()
+
+		first := put(s, 10, "user-1")
+		for n := 0; n < 10; n++ {
+			assert.Equal(t, put(s, 10, "user-1"), first)
+		}
+
+		used := make(map[int]bool)
+		for n := 0; n < 32; n++ {
+			used[put(s, 10, fmt.Sprintf("user-%d", n))] = true
+		}
+		assert.Greater(t, len(used), 1)
+	})
+
+	// 并发写入分散到所有可写的存储引擎, 都能读出来
+	t.Run("parallel", func(t *testing.T) {
+		s := open("parallel", Options{Max: 4 * MB, SegmentSize: MB, ActiveSegments: 4})
+		defer s.Close()
+
+		var mu sync.Mutex
+		ids := make(map[string]string)
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for n := 0; n < 50; n++ {
+					data := fmt.Sprintf("hello %d-%d", w, n)
+					index, err := s.Put([]byte(data))
+					assert.NoError(t, err)
+					mu.Lock()
+					ids[index] = data
+					mu.Unlock()
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		assert.Len(t, s.segments(), 4)
+		for index, data := range ids {
+			elem, ok, err := s.Get(index)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, string(elem.Data), data)
+		}
+	})
+}
+
+// 并发写入时可写的存储引擎个数对吞吐的影响
+func Benchmark_GroupPut(b *testing.B) {
+	data := bytes.Repeat([]byte("x"), 4*int(KB))
+	for _, active := range []int{1, 4} {
+		b.Run(fmt.Sprintf("active=%d", active), func(b *testing.B) {
+			dir := fmt.Sprintf("./testdata/bench_group_put_%d", active)
+			os.RemoveAll(dir)
+			s, err := OpenWithOptions(dir, Options{Max: 64 * GB, SegmentSize: 16 * GB, ActiveSegments: active})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			defer s.Close()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.Put(data); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
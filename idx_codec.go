@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// 定长的idx记录, 记录类型是recordIdxFixed, 手写编解码, 不用protobuf和反射
+// payload固定48个字节, 小端:
+// 0  8个字节的key
+// 8  8个字节的offset
+// 16 4个字节的size
+// 20 4个字节的crc32
+// 24 8个字节的过期时间, 删除记录是删除时间
+// 32 4个字节的cookie
+// 36 4个字节的元数据长度
+// 40 4个字节的标志位, 和IdxVersion1一样, 见idxFlag开头的常量
+// 44 4个字节的crc32, 校验前面的44个字节, 写了一半或者坏掉的记录解码失败, 加载时从这里截断
+
+const (
+	fixedPayloadLen = 48
+	fixedRecordLen  = 4 + fixedPayloadLen
+)
+
+var errFixedCrc = errors.New("fixed idx record crc mismatch")
+
+// 把一条写入记录编码到buf, buf至少要有fixedRecordLen个字节
+func encodeFixed(buf []byte, key int64, index *Index, flags uint32) {
+	_ = buf[fixedRecordLen-1]
+	binary.LittleEndian.PutUint32(buf, recordIdxFixed<<recordTypeShift|fixedPayloadLen)
+	p := buf[4:]
+	binary.LittleEndian.PutUint64(p[0:], uint64(key))
+	binary.LittleEndian.PutUint64(p[8:], uint64(index.Offset))
+	binary.LittleEndian.PutUint32(p[16:], uint32(index.Size))
+	binary.LittleEndian.PutUint32(p[20:], index.Crc32)
+	binary.LittleEndian.PutUint64(p[24:], uint64(index.Timeout))
+	binary.LittleEndian.PutUint32(p[32:], index.Cookie)
+	binary.LittleEndian.PutUint32(p[36:], uint32(index.MetaSize))
+	binary.LittleEndian.PutUint32(p[40:], flags)
+	binary.LittleEndian.PutUint32(p[44:], crc32.Checksum(p[:44], defaultTable))
+}
+
+// 解码payload, 不包括4个字节的头
+func decodeFixed(p []byte) (key int64, index Index, deleted bool, err error) {
+	if len(p) != fixedPayloadLen {
+		err = fmt.Errorf("bad fixed idx record length:%d", len(p))
+		return
+	}
+
+	// 先校验crc, 坏掉的记录不能当成新版本的标志位
+	if crc32.Checksum(p[:44], defaultTable) != binary.LittleEndian.Uint32(p[44:]) {
+		err = errFixedCrc
+		return
+	}
+
+	flags := binary.LittleEndian.Uint32(p[40:])
+	if flags&^idxFlagKnown != 0 || flags&idxFlagCompressed != 0 {
+		err = fmt.Errorf("%w:flags(%#x)", ErrUnknownRecord, flags)
+		return
+	}
+
+	key = int64(binary.LittleEndian.Uint64(p[0:]))
+	if flags&idxFlagTombstone != 0 {
+		return key, index, true, nil
+	}
+
+	index.Key = key
+	index.Offset = int64(binary.LittleEndian.Uint64(p[8:]))
+	index.Size = int32(binary.LittleEndian.Uint32(p[16:]))
+	index.Crc32 = binary.LittleEndian.Uint32(p[20:])
+	index.Timeout = int64(binary.LittleEndian.Uint64(p[24:]))
+	index.Cookie = binary.LittleEndian.Uint32(p[32:])
+	index.MetaSize = int32(binary.LittleEndian.Uint32(p[36:]))
+	return key, index, false, nil
+}
@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 定长记录编码之后能解码回来
+func Test_FixedCodec(t *testing.T) {
+	index := Index{Key: 1 << 40, Size: 5, Offset: 1 << 35, Timeout: 123, Crc32: 0xdeadbeef, Cookie: 7, MetaSize: 9}
+	buf, err := encodePut(index.Key, &index)
+	assert.NoError(t, err)
+	assert.Len(t, buf, fixedRecordLen)
+
+	key, got, deleted, err := decodeRecord(recordIdxFixed, buf[4:])
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, key, index.Key)
+	assert.Equal(t, got, index)
+
+	buf, err = encodeDelete(3)
+	assert.NoError(t, err)
+	key, _, deleted, err = decodeRecord(recordIdxFixed, buf[4:])
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, key, int64(3))
+
+	_, _, _, err = decodeRecord(recordIdxFixed, buf[4:10])
+	assert.Error(t, err)
+
+	// 坏掉的记录crc对不上, 不是新版本的记录
+	buf[4+8] ^= 1
+	_, _, _, err = decodeRecord(recordIdxFixed, buf[4:])
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrUnknownRecord)
+}
+
+// protobuf和定长记录的编解码对比
+func Benchmark_IdxCodec(b *testing.B) {
+	index := Index{Key: 123456, Size: 1024, Offset: 1 << 30, Crc32: 0xdeadbeef, Cookie: 7}
+	pb := &IdxVersion1{Key: index.Key, Size: index.Size, Offset: index.Offset, Crc32: index.Crc32, Cookie: index.Cookie}
+	pbBuf, _ := encodeRecord(recordIdxVersion1, pb)
+	fixedBuf, _ := encodePut(index.Key, &index)
+
+	b.Run("encode/version1", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			encodeRecord(recordIdxVersion1, pb)
+		}
+	})
+
+	b.Run("encode/fixed", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf [fixedRecordLen]byte
+		for i := 0; i < b.N; i++ {
+			encodeFixed(buf[:], index.Key, &index, 0)
+		}
+	})
+
+	b.Run("decode/version1", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodeRecord(recordIdxVersion1, pbBuf[4:])
+		}
+	})
+
+	b.Run("decode/fixed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			decodeRecord(recordIdxFixed, fixedBuf[4:])
+		}
+	})
+}
+
+// 写入, 看每次Put的分配
+func Benchmark_Put(b *testing.B) {
+	name := "./testdata/bench_put"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer index.Close()
+
+	data := []byte("hello world")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = index.Put(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// 启动时加载idx的时间, 重放整个idx和加载快照之后只重放尾部
+func Benchmark_LoadIdx(b *testing.B) {
+	const n = 100000
+	name := fmt.Sprintf("./testdata/bench_load_%d", n)
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err = index.Put([]byte("hello")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	index.Close()
+
+	for _, opt := range []Options{{NoSnapshot: true}, {}} {
+		b.Run(fmt.Sprintf("snapshot=%t", !opt.NoSnapshot), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				index, err := openIndexInMemory(name, &opt)
+				if err != nil {
+					b.Fatal(err)
+				}
+				index.Close()
+			}
+		})
+	}
+}
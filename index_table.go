@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// 索引的三种表示
+// mapTable: map[int64]Index, 每条40个字节的Index加上map自己的开销, 读的时候不用访问磁盘
+// packedTable: 按key排序的两个数组, 每条16个字节(8个字节的key, 8个字节的idx记录位置),
+// 加上一个存放最近写入的小map. 读的时候先二分查找, 再从idx读出记录解码成Index.
+// 小map超过数组的1/4时合并到数组里, 存储引擎写满之后也合并一次, 写满的存储引擎只剩数组
+// diskTable: 索引在磁盘上, 见disk_index.go
+
+type indexTable interface {
+	// 查找key, 紧凑表示需要读idx, 可能返回错误
+	get(key int64) (index Index, ok bool, err error)
+	// key是否存在
+	has(key int64) (bool, error)
+	// 设置key的索引, pos是这条记录在idx里的位置
+	set(key int64, index Index, pos int64)
+	delete(key int64)
+	len() int
+	// 遍历不小于start的key, 顺序不确定, fn返回false停止
+	each(start int64, fn func(key int64, index Index) bool) error
+	// 按key的顺序返回不小于start并且keep返回true的前limit条, limit小于等于0不限
+	ascend(start int64, limit int, keep func(index Index) bool) ([]compactItem, error)
+	// 遍历有过期时间的key
+	eachTTL(fn func(key int64, index Index) bool) error
+	// 把可变的部分合并成紧凑的表示
+	seal()
+}
+
+// 按选项新建索引表, 紧凑表示从idx里读记录
+func newIndexTable(opt *Options, idx *os.File, size int) indexTable {
+	switch {
+	case opt.PackedIndex:
+		return &packedTable{idx: idx, recent: make(map[int64]recentEntry)}
+	case opt.DiskIndex:
+		return newDiskTable(opt.DiskIndexCache)
+	}
+	return make(mapTable, size)
+}
+
+type mapTable map[int64]Index
+
+func (m mapTable) get(key int64) (index Index, ok bool, err error) {
+	index, ok = m[key]
+	return
+}
+
+func (m mapTable) has(key int64) (bool, error) {
+	_, ok := m[key]
+	return ok, nil
+}
+
+func (m mapTable) set(key int64, index Index, pos int64) {
+	m[key] = index
+}
+
+func (m mapTable) delete(key int64) {
+	delete(m, key)
+}
+
+func (m mapTable) len() int {
+	return len(m)
+}
+
+func (m mapTable) each(start int64, fn func(key int64, index Index) bool) error {
+	for key, index := range m {
+		if key < start {
+			continue
+		}
+		if !fn(key, index) {
+			break
+		}
+	}
+	return nil
+}
+
+// map没有顺序, 用大顶堆只留下key最小的limit条
+func (m mapTable) ascend(start int64, limit int, keep func(index Index) bool) ([]compactItem, error) {
+	top := newTopKeys(limit)
+	for key, index := range m {
+		if key >= start && top.wants(key) && keep(index) {
+			top.add(key, index)
+		}
+	}
+	return top.sorted(), nil
+}
+
+func (m mapTable) eachTTL(fn func(key int64, index Index) bool) error {
+	for key, index := range m {
+		if index.Timeout == 0 {
+			continue
+		}
+		if !fn(key, index) {
+			break
+		}
+	}
+	return nil
+}
+
+func (m mapTable) seal() {}
+
+// locs里的位置, 低63位是idx里的位置, 最高位表示有过期时间
+const (
+	locTTL  = 1 << 63
+	locDead = math.MaxUint64
+	// 小map至少攒这么多条才合并
+	minRecent = 4096
+)
+
+type recentEntry struct {
+	Index
+	pos int64
+}
+
+type packedTable struct {
+	idx *os.File
+
+	// 按key排序, 删除的位置标记成locDead, 合并的时候去掉
+	keys []int64
+	locs []uint64
+	live int
+
+	// 最近的写入
+	recent map[int64]recentEntry
+}
+
+func makeLoc(index Index, pos int64) uint64 {
+	loc := uint64(pos)
+	if index.Timeout != 0 {
+		loc |= locTTL
+	}
+	return loc
+}
+
+// 在数组里查找key, 找不到或者已经删除返回-1
+func (p *packedTable) search(key int64) int {
+	n := sort.Search(len(p.keys), func(i int) bool { return p.keys[i] >= key })
+	if n < len(p.keys) && p.keys[n] == key && p.locs[n] != locDead {
+		return n
+	}
+	return -1
+}
+
+// 从idx读出一条写入记录
+func (p *packedTable) read(key int64, loc uint64) (index Index, err error) {
+	pos := int64(loc &^ locTTL)
+	var buf [fixedRecordLen]byte
+	n, err := p.idx.ReadAt(buf[:], pos)
+	if n < 4 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return index, fmt.Errorf("%w:key(%d) idx at %d:%s", ErrBadData, key, pos, err)
+	}
+
+	h := binary.LittleEndian.Uint32(buf[:])
+	l := int(h & recordLenMask)
+	var payload []byte
+	if 4+l <= n {
+		payload = buf[4 : 4+l]
+	} else {
+		// 旧版本的记录不是定长的
+		payload = make([]byte, l)
+		if _, err = p.idx.ReadAt(payload, pos+4); err != nil {
+			return index, fmt.Errorf("%w:key(%d) idx at %d:%s", ErrBadData, key, pos, err)
+		}
+	}
+
+	k, index, deleted, err := decodeRecord(h>>recordTypeShift, payload)
+	if err == nil && (deleted || k != key) {
+		err = fmt.Errorf("record of key(%d)", k)
+	}
+	if err != nil {
+		return index, fmt.Errorf("%w:key(%d) idx at %d:%s", ErrBadData, key, pos, err)
+	}
+	return index, nil
+}
+
+func (p *packedTable) get(key int64) (index Index, ok bool, err error) {
+	if e, ok := p.recent[key]; ok {
+		return e.Index, true, nil
+	}
+
+	n := p.search(key)
+	if n < 0 {
+		return index, false, nil
+	}
+
+	index, err = p.read(key, p.locs[n])
+	return index, err == nil, err
+}
+
+func (p *packedTable) has(key int64) (bool, error) {
+	if _, ok := p.recent[key]; ok {
+		return true, nil
+	}
+	return p.search(key) >= 0, nil
+}
+
+func (p *packedTable) set(key int64, index Index, pos int64) {
+	// 重放的时候同一个key可能写了两次
+	if n := p.search(key); n >= 0 {
+		p.locs[n] = locDead
+		p.live--
+	}
+
+	p.recent[key] = recentEntry{Index: index, pos: pos}
+	if len(p.recent) > minRecent && len(p.recent) > len(p.keys)/4 {
+		p.seal()
+	}
+}
+
+func (p *packedTable) delete(key int64) {
+	if _, ok := p.recent[key]; ok {
+		delete(p.recent, key)
+		return
+	}
+
+	if n := p.search(key); n >= 0 {
+		p.locs[n] = locDead
+		p.live--
+	}
+}
+
+func (p *packedTable) len() int {
+	return p.live + len(p.recent)
+}
+
+func (p *packedTable) each(start int64, fn func(key int64, index Index) bool) error {
+	return p.iterate(start, false, fn)
+}
+
+// 数组已经排好序, 和排好序的小map归并, 够limit条就停, 只读用到的idx记录
+func (p *packedTable) ascend(start int64, limit int, keep func(index Index) bool) ([]compactItem, error) {
+	var items []compactItem
+	top := newTopKeys(limit)
+	for key, e := range p.recent {
+		if key >= start && top.wants(key) && keep(e.Index) {
+			top.add(key, e.Index)
+		}
+	}
+	recent := top.sorted()
+
+	n := sort.Search(len(p.keys), func(i int) bool { return p.keys[i] >= start })
+	for limit <= 0 || len(items) < limit {
+		// 同一个key不会同时在数组和小map里活着
+		for n < len(p.keys) && p.locs[n] == locDead {
+			n++
+		}
+
+		if n == len(p.keys) {
+			if len(recent) == 0 {
+				break
+			}
+			items, recent = append(items, recent[0]), recent[1:]
+			continue
+		}
+
+		if len(recent) > 0 && recent[0].key < p.keys[n] {
+			items, recent = append(items, recent[0]), recent[1:]
+			continue
+		}
+
+		index, err := p.read(p.keys[n], p.locs[n])
+		if err != nil {
+			return nil, err
+		}
+		if keep(index) {
+			items = append(items, compactItem{key: p.keys[n], Index: index})
+		}
+		n++
+	}
+	return items, nil
+}
+
+func (p *packedTable) eachTTL(fn func(key int64, index Index) bool) error {
+	return p.iterate(math.MinInt64, true, fn)
+}
+
+func (p *packedTable) iterate(start int64, ttl bool, fn func(key int64, index Index) bool) error {
+	for key, e := range p.recent {
+		if key < start || (ttl && e.Timeout == 0) {
+			continue
+		}
+		if !fn(key, e.Index) {
+			return nil
+		}
+	}
+
+	n := sort.Search(len(p.keys), func(i int) bool { return p.keys[i] >= start })
+	for ; n < len(p.keys); n++ {
+		loc := p.locs[n]
+		if loc == locDead || (ttl && loc&locTTL == 0) {
+			continue
+		}
+
+		index, err := p.read(p.keys[n], loc)
+		if err != nil {
+			return err
+		}
+		if !fn(p.keys[n], index) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// 把小map和数组归并成新的数组, 顺便去掉删除的位置
+func (p *packedTable) seal() {
+	if len(p.recent) == 0 && p.live == len(p.keys) {
+		return
+	}
+
+	recent := make([]int64, 0, len(p.recent))
+	for key := range p.recent {
+		recent = append(recent, key)
+	}
+	sort.Slice(recent, func(a, b int) bool { return recent[a] < recent[b] })
+
+	total := p.live + len(recent)
+	keys := make([]int64, 0, total)
+	locs := make([]uint64, 0, total)
+	n, r := 0, 0
+	for n < len(p.keys) || r < len(recent) {
+		if n < len(p.keys) && p.locs[n] == locDead {
+			n++
+			continue
+		}
+
+		// 同一个key不会同时在数组和小map里活着
+		if r == len(recent) || (n < len(p.keys) && p.keys[n] < recent[r]) {
+			keys = append(keys, p.keys[n])
+			locs = append(locs, p.locs[n])
+			n++
+			continue
+		}
+
+		e := p.recent[recent[r]]
+		keys = append(keys, recent[r])
+		locs = append(locs, makeLoc(e.Index, e.pos))
+		r++
+	}
+
+	p.keys, p.locs, p.live = keys, locs, total
+	p.recent = make(map[int64]recentEntry)
+}
+
+// 按key的大顶堆
+type itemHeap []compactItem
+
+func (h itemHeap) Len() int            { return len(h) }
+func (h itemHeap) Less(a, b int) bool  { return h[a].key > h[b].key }
+func (h itemHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *itemHeap) Push(x interface{}) { *h = append(*h, x.(compactItem)) }
+func (h *itemHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// 从没有顺序的表里挑出key最小的limit条, limit小于等于0全部留下
+type topKeys struct {
+	limit int
+	h     itemHeap
+}
+
+func newTopKeys(limit int) *topKeys {
+	return &topKeys{limit: limit}
+}
+
+// key能不能放进来, 先判断再读索引, 省掉用不到的读取
+func (t *topKeys) wants(key int64) bool {
+	return t.limit <= 0 || len(t.h) < t.limit || key < t.h[0].key
+}
+
+// 调用之前需要wants返回true
+func (t *topKeys) add(key int64, index Index) {
+	item := compactItem{key: key, Index: index}
+	if t.limit <= 0 || len(t.h) < t.limit {
+		heap.Push(&t.h, item)
+		return
+	}
+	t.h[0] = item
+	heap.Fix(&t.h, 0)
+}
+
+// 按key从小到大返回
+func (t *topKeys) sorted() []compactItem {
+	items := []compactItem(t.h)
+	sort.Slice(items, func(a, b int) bool { return items[a].key < items[b].key })
+	t.h = nil
+	return items
+}
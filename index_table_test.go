@@ -0,0 +1,168 @@
+package storage
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 三种索引表示的选项
+var indexTableOptions = []struct {
+	name string
+	opt  Options
+}{
+	{"map", Options{}},
+	{"packed", Options{PackedIndex: true}},
+	{"disk", Options{DiskIndex: true}},
+}
+
+// 三种索引对外的行为一样: 写入, 覆盖同一个key, 删除, 过期, 遍历, 压缩, 重启
+func Test_IndexTable(t *testing.T) {
+	for _, c := range indexTableOptions {
+		t.Run(c.name, func(t *testing.T) {
+			name := "./testdata/index_table_" + c.name
+			removeIndexFiles(name)
+			opt := c.opt
+
+			index, err := openIndexInMemory(name, &opt)
+			assert.NoError(t, err)
+
+			// 超过minRecent, 小map会合并到数组里
+			const n = minRecent * 3
+			for i := int64(0); i < n; i++ {
+				assert.NoError(t, index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i))))
+			}
+			assert.ErrorIs(t, index.PutWithKey(7, []byte("again")), ErrKeyExists)
+
+			// 磁盘索引写成查找文件, 后面的删除和写入在小map里
+			assert.NoError(t, index.autoSnapshot())
+
+			for i := int64(0); i < n; i += 3 {
+				assert.NoError(t, index.Delete(i))
+			}
+
+			// 删除之后可以用同一个key再写
+			assert.NoError(t, index.PutWithKey(3, []byte("hello again")))
+			_, err = index.PutWithTTL([]byte("expired"), time.Nanosecond)
+			assert.NoError(t, err)
+			time.Sleep(time.Millisecond)
+			expired, err := index.Expire(time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, expired, 1)
+
+			check := func(index *IndexInMemory) {
+				for i := int64(0); i < n; i++ {
+					elem, ok, err := index.Get(i)
+					assert.NoError(t, err)
+					switch {
+					case i == 3:
+						assert.Equal(t, elem.Data, []byte("hello again"))
+					case i%3 == 0:
+						assert.False(t, ok)
+					default:
+						assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+					}
+				}
+
+				var keys []int64
+				assert.NoError(t, index.Scan(n-5, 0, func(key int64, _ Index) bool {
+					keys = append(keys, key)
+					return true
+				}))
+				assert.Equal(t, keys, []int64{n - 5, n - 4, n - 2, n - 1})
+
+				// 按顺序只取前limit条, 跳过删除的
+				keys = keys[:0]
+				assert.NoError(t, index.Scan(2, 3, func(key int64, _ Index) bool {
+					keys = append(keys, key)
+					return true
+				}))
+				assert.Equal(t, keys, []int64{2, 3, 4})
+				assert.Equal(t, index.allIndex.len(), 2*n/3+1)
+			}
+
+			check(index)
+			assert.NoError(t, index.Compact())
+			check(index)
+			assert.NoError(t, index.Close())
+
+			index, err = openIndexInMemory(name, &opt)
+			assert.NoError(t, err)
+			defer index.Close()
+			check(index)
+		})
+	}
+}
+
+// 合并时去掉删除的位置, 同一个key写两次以后面的为准
+func Test_PackedTableSeal(t *testing.T) {
+	p := newIndexTable(&Options{PackedIndex: true}, nil, 0).(*packedTable)
+	for key := int64(10); key > 0; key-- {
+		p.set(key, Index{Size: int32(key)}, key*100)
+	}
+	p.seal()
+	assert.Len(t, p.recent, 0)
+	assert.Equal(t, p.keys, []int64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+
+	p.delete(5)
+	p.set(6, Index{Size: 60}, 6000)
+	ok, _ := p.has(5)
+	assert.False(t, ok)
+	ok, _ = p.has(6)
+	assert.True(t, ok)
+	assert.Equal(t, p.len(), 9)
+
+	index, ok, err := p.get(6)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, index.Size, int32(60))
+
+	p.seal()
+	assert.Equal(t, p.keys, []int64{1, 2, 3, 4, 6, 7, 8, 9, 10})
+	assert.Equal(t, p.locs[4], uint64(6000))
+}
+
+// 每条索引占用的内存
+func Benchmark_IndexMemory(b *testing.B) {
+	const n = 1000000
+	for _, packed := range []bool{false, true} {
+		b.Run(fmt.Sprintf("packed=%t", packed), func(b *testing.B) {
+			var before, after runtime.MemStats
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				table := newIndexTable(&Options{PackedIndex: packed}, nil, 0)
+				for key := int64(0); key < n; key++ {
+					table.set(key, Index{Key: key, Size: 1024, Offset: key * 1024}, key*fixedRecordLen)
+				}
+				table.seal()
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/n, "B/entry")
+				runtime.KeepAlive(table)
+			}
+		})
+	}
+}
+
+// 删除不存在的key和重复删除, 个数不变
+func Test_IndexTableDeleteMissing(t *testing.T) {
+	for _, opt := range []Options{{}, {PackedIndex: true}, {DiskIndex: true}} {
+		table := newIndexTable(&opt, nil, 0)
+		table.set(1, Index{Size: 1}, 0)
+		table.set(2, Index{Size: 2}, 100)
+		table.delete(3)
+		table.delete(1)
+		table.delete(1)
+		assert.Equal(t, table.len(), 1)
+
+		ok, err := table.has(2)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// 目录锁, 防止两个进程同时写同一个目录
+// 写进程打开时对LOCK文件加排他锁, 并写入自己的pid, 进程退出锁自动释放
+// 只读打开不碰LOCK文件, 可以和写进程同时存在
+
+const lockFileName = "LOCK"
+
+var ErrLocked = errors.New("storage is locked by another process")
+
+// 目录已经被别的进程锁住, errors.Is(err, ErrLocked)为true
+type LockedError struct {
+	Dir string
+	// 持有锁的进程, 读不到时为0
+	PID int
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s: dir(%s) pid(%d)", ErrLocked, e.Dir, e.PID)
+}
+
+func (e *LockedError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// 对目录加排他锁
+func lockDir(dir string, perm os.FileMode) (f *os.File, err error) {
+	f, err = os.OpenFile(dirName(dir)+lockFileName, os.O_CREATE|os.O_RDWR, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := tryLockExclusive(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if !ok {
+		pid := readPID(f)
+		f.Close()
+		return nil, &LockedError{Dir: dir, PID: pid}
+	}
+
+	if err = f.Truncate(0); err != nil {
+		unlockDir(f)
+		return nil, err
+	}
+
+	if _, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		unlockDir(f)
+		return nil, err
+	}
+	return f, nil
+}
+
+// 读出持有锁的进程pid
+func readPID(f *os.File) int {
+	buf, err := io.ReadAll(io.NewSectionReader(f, 0, 32))
+	if err != nil {
+		return 0
+	}
+
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(buf)))
+	return pid
+}
+
+// 释放目录锁, LOCK文件保留
+func unlockDir(f *os.File) error {
+	if err := unlock(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
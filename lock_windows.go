@@ -0,0 +1,41 @@
+//go:build windows
+
+package storage
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// windows下没有flock, 用LockFileEx代替
+// LockFileEx锁的是字节区间, 而且是强制的, 锁住的区间别的句柄读写都会失败.
+// 所以只锁文件末尾之外很远的一个字节, 不挡住LOCK里的pid和idx的读写, 效果和flock一样
+
+const (
+	lockOffsetHigh = 0x7fffffff
+	lockBytes      = 1
+)
+
+func lockRange() *windows.Overlapped {
+	return &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+}
+
+// 加共享锁, 拿不到会阻塞
+func lockShared(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), 0, 0, lockBytes, 0, lockRange())
+}
+
+// 尝试加排他锁, 已经被别人锁住返回false
+func tryLockExclusive(f *os.File) (bool, error) {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, lockBytes, 0, lockRange())
+	if err == windows.ERROR_LOCK_VIOLATION || err == windows.ERROR_IO_PENDING {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(f *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, lockBytes, 0, lockRange())
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 对象的元数据
+// 用protobuf(ObjectMeta)编码, 写在数据文件里数据的前面, 索引里记录长度(MetaSize),
+// Offset还是指向数据的开头, 所以读数据的流程不用变, 元数据不参与crc计算
+
+// 元数据编码之后的最大长度
+const MaxMetaSize = 64 * 1024
+
+var ErrMetaSize = errors.New("metadata is too large")
+
+type Metadata struct {
+	// 内容类型, 比如image/png
+	MIME string `json:"mime,omitempty"`
+	// 原始文件名
+	Name string `json:"name,omitempty"`
+	// 修改时间
+	ModTime time.Time `json:"mtime,omitempty"`
+	// 自定义的键值对
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// 编码元数据, nil编码成空
+func encodeMeta(m *Metadata) ([]byte, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	pb := &ObjectMeta{Mime: m.MIME, Name: m.Name}
+	if !m.ModTime.IsZero() {
+		pb.Mtime = m.ModTime.UnixNano()
+	}
+
+	// 按key排序, 同样的元数据编码结果一样
+	keys := make([]string, 0, len(m.Tags))
+	for k := range m.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pb.Tags = append(pb.Tags, &MetaTag{Key: k, Value: m.Tags[k]})
+	}
+
+	buf, err := proto.Marshal(pb)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) > MaxMetaSize {
+		return nil, fmt.Errorf("%w:%d", ErrMetaSize, len(buf))
+	}
+	return buf, nil
+}
+
+func decodeMeta(buf []byte) (*Metadata, error) {
+	var pb ObjectMeta
+	if err := proto.Unmarshal(buf, &pb); err != nil {
+		return nil, err
+	}
+
+	m := &Metadata{MIME: pb.Mime, Name: pb.Name}
+	if pb.Mtime != 0 {
+		m.ModTime = time.Unix(0, pb.Mtime)
+	}
+
+	if len(pb.Tags) > 0 {
+		m.Tags = make(map[string]string, len(pb.Tags))
+		for _, t := range pb.Tags {
+			m.Tags[t.Key] = t.Value
+		}
+	}
+	return m, nil
+}
+
+// 读取数据前面的元数据, 没有元数据返回nil
+func readMeta(dat *os.File, key int64, index Index) (*Metadata, error) {
+	if index.MetaSize == 0 {
+		return nil, nil
+	}
+
+	buf := make([]byte, index.MetaSize)
+	if _, err := dat.ReadAt(buf, index.Offset-int64(index.MetaSize)); err != nil {
+		return nil, err
+	}
+
+	m, err := decodeMeta(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w:key(%d) meta:%s", ErrBadData, key, err)
+	}
+	return m, nil
+}
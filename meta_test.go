@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 元数据和数据一起保存, 压缩和重启之后还在
+func Test_PutMeta(t *testing.T) {
+	name := "./testdata/meta"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+
+	meta := &Metadata{
+		MIME:    "text/plain",
+		Name:    "a.txt",
+		ModTime: time.Unix(1600000000, 0),
+		Tags:    map[string]string{"owner": "bob"},
+	}
+	assert.NoError(t, index.PutWithKey(0, []byte("garbage")))
+	assert.NoError(t, index.PutReaderWithKey(1, strings.NewReader("hello"), 5, PutOptions{Meta: meta}))
+	assert.NoError(t, index.Delete(0))
+	assert.NoError(t, index.Compact())
+	assert.NoError(t, index.Close())
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	elem, ok, err := index.Get(1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+	assert.Equal(t, elem.Meta.MIME, meta.MIME)
+	assert.Equal(t, elem.Meta.Name, meta.Name)
+	assert.True(t, elem.Meta.ModTime.Equal(meta.ModTime))
+	assert.Equal(t, elem.Meta.Tags, meta.Tags)
+
+	obj, ok, err := index.OpenObject(1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	defer obj.Close()
+	assert.Equal(t, obj.Meta.Name, "a.txt")
+	all, err := io.ReadAll(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, string(all), "hello")
+
+	big := &Metadata{Name: strings.Repeat("a", MaxMetaSize)}
+	assert.ErrorIs(t, index.PutReaderWithKey(2, strings.NewReader("hello"), 5, PutOptions{Meta: big}), ErrMetaSize)
+}
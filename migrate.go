@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 格式迁移
+// 把idx里旧版本的记录按原来的顺序一条一条重写成当前的定长记录,
+// 数据文件和元数据不变. 新的idx先写到.idx.migrate, 刷盘之后rename替换旧的idx,
+// 中途退出只会留下临时文件, 下次打开时删除
+
+const migrateSuffix = ".migrate"
+
+// 支持格式迁移的存储引擎需要实现这个接口
+type Migrater interface {
+	// 把旧版本的记录重写成新版本, 没有旧版本的记录时什么都不做, 返回false
+	Migrate() (migrated bool, err error)
+}
+
+// 删除上次没有做完的迁移留下的临时文件
+func removeMigrateTmp(name string) {
+	os.Remove(idxName(name) + migrateSuffix)
+}
+
+func (i *IndexInMemory) Migrate() (migrated bool, err error) {
+	if i.opt.ReadOnly {
+		return false, ErrReadOnly
+	}
+
+	if !i.compactMu.TryLock() {
+		return false, ErrCompacting
+	}
+	defer i.compactMu.Unlock()
+
+	if migrated, err = i.migrate(); err != nil || !migrated {
+		return migrated, err
+	}
+
+	// 磁盘索引的查找文件对应的是旧的idx, 重写一份
+	if i.opt.DiskIndex {
+		return true, i.autoSnapshot()
+	}
+	return true, nil
+}
+
+// 需要持有compactMu
+func (i *IndexInMemory) migrate() (migrated bool, err error) {
+	// 迁移期间不能写入
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	i.rwmu.Lock()
+	defer i.rwmu.Unlock()
+
+	if i.oldRecords == 0 {
+		return false, nil
+	}
+
+	tmp, err := os.OpenFile(idxName(i.name)+migrateSuffix, os.O_CREATE|os.O_TRUNC|os.O_RDWR, i.opt.FileMode)
+	if err != nil {
+		return false, err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	offset, err := i.rewriteIdx(tmp)
+	if err != nil {
+		return false, err
+	}
+
+	if err = tmp.Sync(); err != nil {
+		return false, err
+	}
+
+	// 和压缩一样, 有只读打开的进程时不替换, 替换完成之前新文件也不能被打开
+	ok, err := tryLockExclusive(i.idx)
+	if err != nil {
+		return false, err
+	}
+
+	if !ok {
+		return false, ErrInUse
+	}
+
+	if _, err = tryLockExclusive(tmp); err != nil {
+		unlock(i.idx)
+		return false, err
+	}
+	defer unlock(tmp)
+
+	// 快照对应的是旧的idx, 删除落盘之后才能rename, 不然崩溃之后旧的快照会配上新的idx
+	if err = removeSnapshot(i.name); err == nil {
+		err = syncDir(i.name)
+	}
+	if err != nil {
+		unlock(i.idx)
+		return false, err
+	}
+
+	if err = os.Rename(tmp.Name(), idxName(i.name)); err != nil {
+		unlock(i.idx)
+		return false, err
+	}
+
+	// 和压缩一样, rename没有落盘就不能接着写旧的idx
+	if err = syncDir(i.name); err != nil {
+		i.Readonly = true
+		unlock(i.idx)
+		return false, err
+	}
+
+	committed = true
+	i.fileMu.Lock()
+	i.idx.Close()
+	i.idx = tmp
+	i.fileMu.Unlock()
+	i.snapOffset = -1
+
+	// 记录在idx里的位置变了, 紧凑的索引要重新加载
+	if i.opt.PackedIndex {
+		return true, i.reloadIdx()
+	}
+
+	i.idxOffset = offset
+	i.oldRecords = 0
+	_, err = i.idx.Seek(offset, io.SeekStart)
+	return true, err
+}
+
+// 从头重放idx, 重新建立内存索引, 需要持有写锁
+func (i *IndexInMemory) reloadIdx() error {
+	i.allIndex = newIndexTable(&i.opt, i.idx, i.allIndex.len())
+	i.idxOffset = 0
+	i.oldRecords = 0
+	if err := i.loadIdx(); err != nil {
+		return err
+	}
+	i.allIndex.seal()
+	return nil
+}
+
+// 按顺序把idx里的记录重写成新版本写到w, 返回写入的字节数
+func (i *IndexInMemory) rewriteIdx(w io.Writer) (offset int64, err error) {
+	var head [4]byte
+	for pos := int64(0); pos < i.idxOffset; {
+		if _, err = i.idx.ReadAt(head[:], pos); err != nil {
+			return 0, err
+		}
+
+		h := binary.LittleEndian.Uint32(head[:])
+		buf := make([]byte, h&recordLenMask)
+		if _, err = i.idx.ReadAt(buf, pos+4); err != nil {
+			return 0, err
+		}
+
+		typ := h >> recordTypeShift
+		if typ != recordCurrent {
+			key, index, deleted, err := decodeRecord(typ, buf)
+			if err != nil {
+				return 0, fmt.Errorf("migrate idx at %d:%w", pos, err)
+			}
+
+			if deleted {
+				buf, err = encodeDelete(key)
+			} else {
+				buf, err = encodePut(key, &index)
+			}
+			if err != nil {
+				return 0, err
+			}
+		} else {
+			buf = append(head[:], buf...)
+		}
+
+		n, err := w.Write(buf)
+		if err != nil {
+			return 0, err
+		}
+		offset += int64(n)
+		pos += int64(len(head)) + int64(h&recordLenMask)
+	}
+	return offset, nil
+}
+
+// 迁移所有的存储引擎, 返回迁移了的个数
+func (g *Group) Migrate() (n int, err error) {
+	for _, s := range g.segments() {
+		m, ok := s.(Migrater)
+		if !ok {
+			continue
+		}
+
+		migrated, err := m.Migrate()
+		if err != nil {
+			return n, err
+		}
+
+		if migrated {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// 迁移默认的桶和所有的桶
+func (s Storage) Migrate() (n int, err error) {
+	if n, err = s.Group.Migrate(); err != nil {
+		return
+	}
+
+	s.buckets.mu.RLock()
+	defer s.buckets.mu.RUnlock()
+	for _, g := range s.buckets.groups {
+		count, err := g.Migrate()
+		n += count
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
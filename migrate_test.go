@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+)
+
+// 用旧版本的记录写一个存储引擎
+func writeVersion0(t *testing.T, name string) {
+	removeIndexFiles(name)
+	assert.NoError(t, os.WriteFile(datName(name), []byte("helloworld"), 0644))
+
+	var idx []byte
+	for _, r := range []struct {
+		typ uint32
+		m   proto.Message
+	}{
+		{recordIdxVersion0, &IdxVersion0{Key: 1 << 33, Size: 5, Offset: 0, Crc32: crc32.Checksum([]byte("hello"), defaultTable)}},
+		{recordIdxVersion0, &IdxVersion0{Key: 2, Size: 5, Offset: 5, Crc32: crc32.Checksum([]byte("world"), defaultTable)}},
+		{recordTombstone, &IdxTombstone{Key: 2}},
+	} {
+		buf, err := encodeRecord(r.typ, r.m)
+		assert.NoError(t, err)
+		idx = append(idx, buf...)
+	}
+	assert.NoError(t, os.WriteFile(idxName(name), idx, 0644))
+}
+
+// 旧版本的记录能读, 64位的key不会被截断, 迁移之后还能读
+// 紧凑的索引从idx里读记录, 迁移之后记录的位置变了也要能读, 磁盘索引迁移之后重写查找文件
+func Test_Migrate(t *testing.T) {
+	for _, c := range indexTableOptions {
+		t.Run(c.name, func(t *testing.T) {
+			opt := c.opt
+			testMigrate(t, &opt)
+		})
+	}
+}
+
+func testMigrate(t *testing.T, opt *Options) {
+	name := "./testdata/migrate"
+	writeVersion0(t, name)
+
+	index, err := openIndexInMemory(name, opt)
+	assert.NoError(t, err)
+
+	check := func() {
+		elem, ok, err := index.Get(1 << 33)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, string(elem.Data), "hello")
+		assert.Equal(t, elem.Key, int64(1<<33))
+
+		_, ok, err = index.Get(2)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+	check()
+
+	migrated, err := index.Migrate()
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	check()
+
+	// 迁移之后还能继续写
+	assert.NoError(t, index.PutWithKey(3, []byte("!")))
+	assert.NoError(t, index.Close())
+
+	index, err = openIndexInMemory(name, opt)
+	assert.NoError(t, err)
+	defer index.Close()
+	assert.False(t, index.Recovery().Recovered())
+	assert.Equal(t, index.oldRecords, 0)
+	check()
+
+	migrated, err = index.Migrate()
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+}
+
+// 不认识的记录类型不能当成坏掉的记录截断
+func Test_UnknownRecord(t *testing.T) {
+	name := "./testdata/unknown_record"
+	removeIndexFiles(name)
+	putN(t, name, 1)
+
+	buf, err := encodeRecord(100, &IdxVersion1{Key: 1})
+	assert.NoError(t, err)
+	f, err := os.OpenFile(idxName(name), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write(buf)
+	f.Close()
+
+	_, err = newIndexInMemory(name)
+	assert.ErrorIs(t, err, ErrUnknownRecord)
+}
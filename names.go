@@ -0,0 +1,396 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// 名字索引
+// 把用户给的名字(比如文件路径)映射到文件id, 保存在组目录的names文件里(内存后端在内存里)
+// 格式和.idx一样, 4个字节的头(高8位是记录类型, 低24位是长度)加protobuf, 现在写的记录在protobuf后面
+// 跟4个字节的crc32. 启动时重放, 从第一条不完整或者校验不过的记录开始截断掉
+// 覆盖和删除都是追加记录, 打开和关闭时记录比名字多就把活着的名字重写成新文件, 写好之后rename
+//
+// 写入顺序是先写数据, 再写名字记录, 覆盖的时候最后删除旧数据,
+// 中间崩溃最多留下没有名字指向的数据. 没有开刷盘(Options.Sync)时最后几条名字记录可能丢掉
+
+// 名字索引的记录类型
+const (
+	recordName             = 0 // 内容是NameEntry, 旧版本写的, 没有crc
+	recordNameTombstone    = 1 // 内容是NameTombstone, 旧版本写的, 没有crc
+	recordNameCrc          = 2 // NameEntry加4个字节的crc32
+	recordNameTombstoneCrc = 3 // NameTombstone加4个字节的crc32
+)
+
+var (
+	ErrNoNameIndex = errors.New("name index is not enabled")
+	ErrIllegalName = errors.New("Illegal name")
+)
+
+const namesFile = "names"
+
+type nameIndex struct {
+	mu      sync.RWMutex
+	home    groupDir
+	f       namesLog
+	offset  int64
+	records int //日志里的记录数, 比名字多说明可以压缩
+	names   map[string]FileID
+	opt     *Options
+}
+
+func openNameIndex(home groupDir, opt *Options) (n *nameIndex, err error) {
+	n = &nameIndex{home: home, names: make(map[string]FileID), opt: opt}
+	if n.f, err = home.openNames(); err != nil || n.f == nil {
+		return n, err
+	}
+
+	if err = n.load(); err == nil {
+		err = n.compact()
+	}
+	if err != nil {
+		n.f.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// 重放名字记录
+func (n *nameIndex) load() (err error) {
+	var head [4]byte
+	torn := false
+	for {
+		l, err := n.f.ReadAt(head[:], n.offset)
+		if err == io.EOF && l == 0 {
+			break
+		}
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if l < len(head) {
+			torn = true
+			break
+		}
+
+		h := binary.LittleEndian.Uint32(head[:])
+		// 掉电之后尾部填0的块
+		if h&recordLenMask == 0 {
+			torn = true
+			break
+		}
+
+		buf := make([]byte, h&recordLenMask)
+		if _, err = n.f.ReadAt(buf, n.offset+4); err != nil {
+			if err != io.EOF {
+				return err
+			}
+			torn = true
+			break
+		}
+
+		if err = n.replay(h>>recordTypeShift, buf); err != nil {
+			torn = true
+			break
+		}
+		n.offset += int64(len(buf)) + 4
+		n.records++
+	}
+
+	// 只读打开时尾部可能是写进程正在写的记录, 忽略就行
+	if torn && !n.opt.ReadOnly {
+		if err = n.f.Truncate(n.offset); err != nil {
+			return err
+		}
+	}
+
+	_, err = n.f.Seek(n.offset, io.SeekStart)
+	return err
+}
+
+func (n *nameIndex) replay(typ uint32, buf []byte) (err error) {
+	switch typ {
+	case recordNameCrc, recordNameTombstoneCrc:
+		if len(buf) < 4 {
+			return fmt.Errorf("name record too short:%d", len(buf))
+		}
+
+		payload := buf[:len(buf)-4]
+		if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(buf[len(payload):]) {
+			return errors.New("name record crc mismatch")
+		}
+		return n.replay(typ-recordNameCrc, payload)
+	case recordName:
+		var e NameEntry
+		if err = proto.Unmarshal(buf, &e); err != nil {
+			return err
+		}
+		n.names[e.Name] = FileID{GroupIndex: int(e.Group), Key: e.Key, Cookie: e.Cookie}
+		return nil
+	case recordNameTombstone:
+		var tomb NameTombstone
+		if err = proto.Unmarshal(buf, &tomb); err != nil {
+			return err
+		}
+		delete(n.names, tomb.Name)
+		return nil
+	}
+
+	return fmt.Errorf("unknown name record type:%d", typ)
+}
+
+// 追加一条记录, 需要持有写锁
+func (n *nameIndex) append(typ uint32, m proto.Message) (err error) {
+	if n.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	buf, err := encodeNameRecord(nil, typ, m)
+	if err != nil {
+		return err
+	}
+
+	if _, err = n.f.Write(buf); err != nil {
+		n.f.Truncate(n.offset)
+		n.f.Seek(n.offset, io.SeekStart)
+		return err
+	}
+	n.offset += int64(len(buf))
+	n.records++
+
+	// 名字记录很少, 只要开了刷盘就每次都刷
+	if n.opt.Sync != SyncNone {
+		return n.f.Sync()
+	}
+	return nil
+}
+
+// 编码一条带crc的名字记录, 追加到buf后面, typ是不带crc的记录类型
+func encodeNameRecord(buf []byte, typ uint32, m proto.Message) ([]byte, error) {
+	all, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = binary.LittleEndian.AppendUint32(buf, (typ+recordNameCrc)<<recordTypeShift|uint32(len(all)+4))
+	buf = append(buf, all...)
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(all)), nil
+}
+
+// 记录比名字多的时候, 把活着的名字重写成新的日志, 替换掉旧的, 需要持有写锁或者还没有开始用
+func (n *nameIndex) compact() (err error) {
+	if n.opt.ReadOnly || n.records <= len(n.names) {
+		return nil
+	}
+
+	names := make([]string, 0, len(n.names))
+	for name := range n.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf []byte
+	for _, name := range names {
+		id := n.names[name]
+		buf, err = encodeNameRecord(buf, recordName, &NameEntry{Name: name, Group: int32(id.GroupIndex), Key: id.Key, Cookie: id.Cookie})
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := n.home.replaceNames(buf)
+	if err != nil {
+		return err
+	}
+
+	n.f.Close()
+	n.f = f
+	n.offset = int64(len(buf))
+	n.records = len(names)
+	return nil
+}
+
+// 设置名字指向的文件, 返回旧的文件id
+func (n *nameIndex) set(name string, id FileID) (old FileID, ok bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	err = n.append(recordName, &NameEntry{Name: name, Group: int32(id.GroupIndex), Key: id.Key, Cookie: id.Cookie})
+	if err != nil {
+		return
+	}
+
+	old, ok = n.names[name]
+	n.names[name] = id
+	return
+}
+
+func (n *nameIndex) get(name string) (id FileID, ok bool) {
+	n.mu.RLock()
+	id, ok = n.names[name]
+	n.mu.RUnlock()
+	return
+}
+
+// 删除名字, 返回它指向的文件id
+func (n *nameIndex) delete(name string) (id FileID, ok bool, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if id, ok = n.names[name]; !ok {
+		return
+	}
+
+	if err = n.append(recordNameTombstone, &NameTombstone{Name: name, Time: time.Now().UnixNano()}); err != nil {
+		return FileID{}, false, err
+	}
+	delete(n.names, name)
+	return
+}
+
+// 返回所有以prefix开头的名字, 按字典序排列
+func (n *nameIndex) list(prefix string) (names []string) {
+	n.mu.RLock()
+	for name := range n.names {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	n.mu.RUnlock()
+
+	sort.Strings(names)
+	return
+}
+
+func (n *nameIndex) close() (err error) {
+	return n.release(true)
+}
+
+// 组马上要删除, 不用压缩
+func (n *nameIndex) discard() (err error) {
+	return n.release(false)
+}
+
+func (n *nameIndex) release(compact bool) (err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.f == nil {
+		return nil
+	}
+
+	// 压缩失败不影响关闭, 下次打开再压缩
+	if compact {
+		if err = n.compact(); err != nil {
+			n.opt.Logger.Printf("compact names:%s", err)
+		}
+	}
+	err = n.f.Close()
+	n.f = nil
+	return
+}
+
+func checkName(name string) error {
+	if name == "" || len(name) > recordLenMask/2 {
+		return fmt.Errorf("%w:%q", ErrIllegalName, name)
+	}
+	return nil
+}
+
+// 用名字保存, 名字已经存在就覆盖, 旧的数据会被删除
+func (g *Group) PutNamed(name string, data []byte) (index string, err error) {
+	return g.PutNamedReader(name, bytes.NewReader(data), int64(len(data)))
+}
+
+// 用名字流式保存, 从r读取size个字节
+func (g *Group) PutNamedReader(name string, r io.Reader, size int64) (index string, err error) {
+	if g.names == nil {
+		return "", ErrNoNameIndex
+	}
+
+	if err = checkName(name); err != nil {
+		return "", err
+	}
+
+	id, err := g.putReader(0, false, r, size, PutOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	old, ok, err := g.names.set(name, id)
+	if err != nil {
+		// 名字没写进去, 新数据没有人能找到了
+		g.deleteByID(id)
+		return "", err
+	}
+
+	if ok {
+		if err = g.deleteByID(old); err != nil {
+			g.opt.Logger.Printf("delete overwritten object %s(%s):%s", name, old, err)
+		}
+	}
+	return id.String(), nil
+}
+
+// 用名字读取
+func (g *Group) GetByName(name string) (element Data, ok bool, err error) {
+	id, ok, err := g.lookup(name)
+	if err != nil || !ok {
+		return
+	}
+	return g.GetByID(id)
+}
+
+// 用名字打开一个对象用于流式读取, 用完需要Close
+func (g *Group) OpenObjectByName(name string) (obj *Object, ok bool, err error) {
+	id, ok, err := g.lookup(name)
+	if err != nil || !ok {
+		return
+	}
+	return g.OpenObjectByID(id)
+}
+
+// 删除名字和它指向的数据
+func (g *Group) DeleteByName(name string) (err error) {
+	if g.names == nil {
+		return ErrNoNameIndex
+	}
+
+	if g.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	id, ok, err := g.names.delete(name)
+	if err != nil || !ok {
+		return
+	}
+	return g.DeleteByID(id)
+}
+
+// 返回所有以prefix开头的名字, 按字典序排列
+func (g *Group) ListNames(prefix string) (names []string, err error) {
+	if g.names == nil {
+		return nil, ErrNoNameIndex
+	}
+	return g.names.list(prefix), nil
+}
+
+func (g *Group) lookup(name string) (id FileID, ok bool, err error) {
+	if g.names == nil {
+		return id, false, ErrNoNameIndex
+	}
+
+	id, ok = g.names.get(name)
+	return
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 按名字存取, 覆盖之后旧数据被删除, 重启之后名字还在
+func Test_PutNamed(t *testing.T) {
+	dir := "./testdata/names"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: GB, NameIndex: true})
+	assert.NoError(t, err)
+
+	old, err := s.PutNamed("a/1.txt", []byte("hello"))
+	assert.NoError(t, err)
+	_, err = s.PutNamed("a/1.txt", []byte("world"))
+	assert.NoError(t, err)
+	_, err = s.PutNamed("a/2.txt", []byte("2"))
+	assert.NoError(t, err)
+	_, err = s.PutNamed("b/3.txt", []byte("3"))
+	assert.NoError(t, err)
+
+	_, ok, err := s.Get(old)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, s.DeleteByName("a/2.txt"))
+	assert.NoError(t, s.Close())
+
+	// 模拟写了一半的记录
+	f, err := os.OpenFile(dir+"/names", os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{0x10, 0x00, 0x00})
+	f.Close()
+
+	s, err = OpenWithOptions(dir, Options{Max: GB, NameIndex: true})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	elem, ok, err := s.GetByName("a/1.txt")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "world")
+
+	_, ok, err = s.GetByName("a/2.txt")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	names, err := s.ListNames("a/")
+	assert.NoError(t, err)
+	assert.Equal(t, names, []string{"a/1.txt"})
+
+	names, err = s.ListNames("")
+	assert.NoError(t, err)
+	assert.Equal(t, names, []string{"a/1.txt", "b/3.txt"})
+
+	_, err = s.PutNamed("", []byte("hello"))
+	assert.ErrorIs(t, err, ErrIllegalName)
+}
+
+func Test_NoNameIndex(t *testing.T) {
+	dir := "./testdata/no_names"
+	os.RemoveAll(dir)
+
+	s, err := Open(dir, GB)
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.PutNamed("a", []byte("hello"))
+	assert.ErrorIs(t, err, ErrNoNameIndex)
+	_, _, err = s.GetByName("a")
+	assert.ErrorIs(t, err, ErrNoNameIndex)
+}
+
+// 覆盖和删除追加的记录在关闭和打开时压缩掉, 坏掉的记录从那里截断
+func Test_NamesCompact(t *testing.T) {
+	dir := "./testdata/names_compact"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: GB, NameIndex: true})
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = s.PutNamed("a", []byte(fmt.Sprintf("hello %d", i)))
+		assert.NoError(t, err)
+	}
+	_, err = s.PutNamed("b", []byte("b"))
+	assert.NoError(t, err)
+	assert.NoError(t, s.DeleteByName("b"))
+	_, err = s.PutNamed("c", []byte("c"))
+	assert.NoError(t, err)
+
+	before, err := os.Stat(dir + "/names")
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	after, err := os.Stat(dir + "/names")
+	assert.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size()/4)
+
+	// 最后一条记录(名字c)的crc对不上
+	f, err := os.OpenFile(dir+"/names", os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	f.WriteAt([]byte{'x'}, after.Size()-5)
+	f.Close()
+
+	s, err = OpenWithOptions(dir, Options{Max: GB, NameIndex: true})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	elem, ok, err := s.GetByName("a")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello 9")
+
+	names, err := s.ListNames("")
+	assert.NoError(t, err)
+	assert.Equal(t, names, []string{"a"})
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+var _ io.ReadSeekCloser = (*Object)(nil)
+
+// 从指定的偏移量开始顺序写
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (n int, err error) {
+	n, err = o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return
+}
+
+// 流式读取的对象, 文件后端直接从数据文件里读
+// crc是增量计算的, 只有从上次算到的位置接着读才会更新,
+// 所有数据都算过之后校验, 校验失败那次Read返回ErrBadData.
+// Seek跳着读的部分不参与校验, 跳回来接着顺序读还会继续算
+type Object struct {
+	Index
+	// 元数据, 写入时没有设置为nil
+	Meta *Metadata
+
+	key int64
+	// 数据文件, 内存后端为nil
+	dat    io.Closer
+	r      *io.SectionReader
+	closed bool
+
+	crc    hash.Hash32
+	hashed int64 //已经算过crc的字节数
+	failed bool  //已经返回过校验失败
+}
+
+// 打开一个对象用于流式读取, 对象有自己的文件描述符, 压缩替换文件也不影响已经打开的对象
+func (i *IndexInMemory) OpenObject(key int64) (obj *Object, ok bool, err error) {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
+
+	index, ok, err := i.allIndex.get(key)
+	if err != nil || !ok || index.expired(time.Now().UnixNano()) {
+		return nil, false, err
+	}
+
+	// 持有读锁的时候压缩不会替换文件, 这里打开的一定是i.dat
+	dat, err := os.Open(i.dat.Name())
+	if err != nil {
+		return nil, false, err
+	}
+
+	obj = newObject(key, index, io.NewSectionReader(dat, index.Offset, int64(index.Size)), dat)
+	if obj.Meta, err = readMeta(dat, key, index); err != nil {
+		dat.Close()
+		return nil, false, err
+	}
+	return obj, true, nil
+}
+
+func newObject(key int64, index Index, r *io.SectionReader, dat io.Closer) *Object {
+	return &Object{
+		Index: index,
+		key:   key,
+		dat:   dat,
+		r:     r,
+		crc:   crc32.New(defaultTable),
+	}
+}
+
+func (o *Object) Read(p []byte) (n int, err error) {
+	pos, _ := o.r.Seek(0, io.SeekCurrent)
+	n, err = o.r.Read(p)
+	if o.failed || pos != o.hashed || n == 0 {
+		return
+	}
+
+	o.crc.Write(p[:n])
+	o.hashed += int64(n)
+	if o.hashed == int64(o.Size) && o.crc.Sum32() != o.Crc32 {
+		o.failed = true
+		return n, fmt.Errorf("%w:key(%d)", ErrBadData, o.key)
+	}
+	return
+}
+
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	return o.r.Seek(offset, whence)
+}
+
+func (o *Object) Close() error {
+	if o.closed {
+		return errors.New("object already closed")
+	}
+
+	o.closed = true
+	if o.dat == nil {
+		return nil
+	}
+	return o.dat.Close()
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 流式写入, 流式读出
+func Test_PutReaderOpenObject(t *testing.T) {
+	name := "./testdata/object"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	body := strings.Repeat("hello world", 1000)
+	assert.NoError(t, index.PutReaderWithKey(0, strings.NewReader(body), int64(len(body)), PutOptions{}))
+
+	obj, ok, err := index.OpenObject(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int(obj.Size), len(body))
+
+	all, err := io.ReadAll(obj)
+	assert.NoError(t, err)
+	assert.Equal(t, string(all), body)
+
+	// seek之后读一部分
+	_, err = obj.Seek(6, io.SeekStart)
+	assert.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(obj, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, string(buf), "world")
+	assert.NoError(t, obj.Close())
+
+	_, ok, err = index.OpenObject(1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// 读到的数据不够size, 写入失败, 空间算作垃圾
+func Test_PutReaderShort(t *testing.T) {
+	name := "./testdata/object_short"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	err = index.PutReaderWithKey(0, strings.NewReader("hello"), 10, PutOptions{})
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.Equal(t, index.GarbageRatio(), 1.0)
+
+	_, ok, err := index.Get(0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+// 数据文件被改坏, 顺序读到结尾时返回ErrBadData
+func Test_OpenObjectBadData(t *testing.T) {
+	name := "./testdata/object_bad"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	assert.NoError(t, index.PutWithKey(0, []byte("hello world")))
+
+	f, err := os.OpenFile(datName(name), os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	f.WriteAt([]byte("H"), 0)
+	f.Close()
+
+	obj, ok, err := index.OpenObject(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	defer obj.Close()
+
+	_, err = io.ReadAll(obj)
+	assert.ErrorIs(t, err, ErrBadData)
+}
+
+// 范围读, 只读一部分时默认不校验crc, VerifyRange打开之后校验
+func Test_GetRange(t *testing.T) {
+	name := "./testdata/range"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+
+	assert.NoError(t, index.PutWithKey(0, []byte("hello world")))
+
+	elem, ok, err := index.GetRange(0, 6, 5)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, elem.Data, []byte("world"))
+	assert.Equal(t, elem.Size, int32(11))
+
+	elem, _, err = index.GetRange(0, 6, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, elem.Data, []byte("world"))
+
+	elem, _, err = index.GetRange(0, 0, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, elem.Data, []byte("hello world"))
+
+	_, _, err = index.GetRange(0, 12, 1)
+	assert.ErrorIs(t, err, ErrRange)
+	assert.NoError(t, index.Close())
+
+	f, err := os.OpenFile(datName(name), os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	f.WriteAt([]byte("H"), 0)
+	f.Close()
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	_, _, err = index.GetRange(0, 6, 5)
+	assert.NoError(t, err)
+	assert.NoError(t, index.Close())
+
+	index, err = openIndexInMemory(name, &Options{VerifyRange: true})
+	assert.NoError(t, err)
+	defer index.Close()
+	_, _, err = index.GetRange(0, 6, 5)
+	assert.ErrorIs(t, err, ErrBadData)
+}
@@ -2,9 +2,42 @@ package storage
 
 type Storage struct {
 	*Group
+	// 目录下的桶, 根目录的Group是默认的桶
+	buckets *buckets
 }
 
+// 打开存储, max是最大容量, 其他选项都用默认值
 func Open(name string, max Size) (s Storage, err error) {
-	s.Group, err = loadOrNewGroup(name, max)
+	return OpenWithOptions(name, Options{Max: max})
+}
+
+// 打开存储, 选项在打开之前校验, 校验失败返回*OptionError
+func OpenWithOptions(dir string, opt Options) (s Storage, err error) {
+	if err = opt.Validate(); err != nil {
+		return
+	}
+
+	opt = opt.withDefaults()
+	if s.Group, err = loadOrNewGroup(dir, &opt); err != nil {
+		return
+	}
+
+	// 加了目录锁之后才能打开桶
+	if s.buckets, err = openBuckets(s.Group.home, &opt); err != nil {
+		s.Group.Close()
+		return Storage{}, err
+	}
+	return
+}
+
+// 关闭所有的桶和默认的桶
+func (s Storage) Close() (err error) {
+	if s.buckets != nil {
+		err = s.buckets.close()
+	}
+
+	if e := s.Group.Close(); e != nil {
+		return e
+	}
 	return
 }
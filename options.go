@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// 刷盘策略
+type SyncMode int
+
+const (
+	// 不主动刷盘, 交给操作系统, 断电可能丢失已经返回成功的写入
+	SyncNone SyncMode = iota
+	// 每次写入都刷盘
+	SyncAlways
+	// 每隔Options.SyncInterval刷盘一次
+	SyncInterval
+	// 组提交, 并发的写入合并成一次刷盘, 刷盘之后才返回
+	SyncGroup
+)
+
+var syncModeNames = []string{"none", "always", "interval", "group"}
+
+func (m SyncMode) String() string {
+	if m < 0 || int(m) >= len(syncModeNames) {
+		return fmt.Sprintf("SyncMode(%d)", int(m))
+	}
+	return syncModeNames[m]
+}
+
+// 解析刷盘策略, 可以是none, always, interval, group
+func ParseSyncMode(s string) (SyncMode, error) {
+	for i, name := range syncModeNames {
+		if name == s {
+			return SyncMode(i), nil
+		}
+	}
+	return SyncNone, fmt.Errorf("unknown sync mode:%s", s)
+}
+
+// 写入分配策略, 有多个可写的存储引擎时选哪一个
+type Placement int
+
+const (
+	// 轮流写
+	PlaceRoundRobin Placement = iota
+	// 写已用空间最少的
+	PlaceLeastFull
+	// 按PutOptions.Hint的hash选, 同样的hint写到同一个存储引擎, 没有hint时轮流写
+	PlaceHash
+)
+
+var placementNames = []string{"round-robin", "least-full", "hash"}
+
+func (p Placement) String() string {
+	if p < 0 || int(p) >= len(placementNames) {
+		return fmt.Sprintf("Placement(%d)", int(p))
+	}
+	return placementNames[p]
+}
+
+// 解析写入分配策略, 可以是round-robin, least-full, hash
+func ParsePlacement(s string) (Placement, error) {
+	for i, name := range placementNames {
+		if name == s {
+			return Placement(i), nil
+		}
+	}
+	return PlaceRoundRobin, fmt.Errorf("unknown placement:%s", s)
+}
+
+// 默认值
+const (
+	// 一个存储引擎最多管理的数据
+	DefaultSegmentSize = 32 * GB
+	// 文件和目录的权限
+	DefaultFileMode os.FileMode = 0644
+	DefaultDirMode  os.FileMode = 0755
+	// 刷盘间隔
+	DefaultSyncInterval = time.Second
+	// 后台检查过期数据的间隔
+	DefaultReapInterval = time.Minute
+	// 写索引快照的间隔
+	DefaultSnapshotInterval = 10 * time.Minute
+	// 磁盘索引每个存储引擎的页缓存
+	DefaultDiskIndexCache = 8 * MB
+	// 存储引擎的后端
+	DefaultBackend = BackendFile
+	// 同时可写的存储引擎个数
+	DefaultActiveSegments = 1
+)
+
+var ErrInvalidOptions = errors.New("invalid options")
+
+// 选项校验失败, errors.Is(err, ErrInvalidOptions)为true
+type OptionError struct {
+	Field  string
+	Value  interface{}
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("%s: %s=%v, %s", ErrInvalidOptions, e.Field, e.Value, e.Reason)
+}
+
+func (e *OptionError) Is(target error) bool {
+	return target == ErrInvalidOptions
+}
+
+// 日志接口, *log.Logger满足这个接口
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
+
+type Options struct {
+	// 最大容量, 决定一个组下面有多少个存储引擎
+	Max Size
+	// 单个存储引擎最多管理的数据, 默认32GB
+	SegmentSize Size
+	// 新建文件的权限, 默认0644
+	FileMode os.FileMode
+	// 新建目录的权限, 默认0755
+	DirMode os.FileMode
+	// 刷盘策略
+	Sync SyncMode
+	// Sync为SyncInterval时的刷盘间隔, 默认1s
+	SyncInterval time.Duration
+	// 后台检查过期数据的间隔, 默认1分钟
+	ReapInterval time.Duration
+	// 只读打开, Put和Delete返回ErrReadOnly
+	ReadOnly bool
+	// GetRange只读一部分数据时, 是否把整个对象读一遍校验crc
+	VerifyRange bool
+	// 打印恢复报告和后台任务的错误, 默认不打印
+	Logger Logger
+	// 打开名字索引, 可以用PutNamed/GetByName按名字存取
+	NameIndex bool
+	// 写索引快照的间隔, 默认10分钟, Close的时候也会写一次
+	SnapshotInterval time.Duration
+	// 不写也不加载索引快照, 启动时重放整个idx
+	NoSnapshot bool
+	// 用紧凑的内存索引, 每条16个字节, 读的时候要多读一次idx, 不使用索引快照
+	// 对所有用文件后端的组生效, 单独的组或者桶用BackendPackedIndex后端,
+	// 组里所有的存储引擎用同一种索引, 不能按存储引擎单独选择
+	PackedIndex bool
+	// 索引放在磁盘上(索引快照文件), 内存里只有最近的变化和页缓存, 需要索引快照
+	// 对所有用文件后端的组生效, 单独的组或者桶用BackendDiskIndex后端, 和PackedIndex一样不能按存储引擎选择
+	DiskIndex bool
+	// 磁盘索引每个存储引擎的页缓存大小, 默认8MB
+	DiskIndexCache Size
+	// 存储引擎的后端, 用RegisterBackend注册, 默认是文件后端, 桶可以单独设置
+	Backend string
+	// 同时可写的存储引擎个数, 默认1, 多个时并发的写入分散到不同的存储引擎
+	ActiveSegments int
+	// 多个可写的存储引擎之间的写入分配策略, 默认轮流写
+	Placement Placement
+}
+
+// 填充默认值
+func (o Options) withDefaults() Options {
+	if o.SegmentSize == 0 {
+		o.SegmentSize = DefaultSegmentSize
+	}
+	if o.FileMode == 0 {
+		o.FileMode = DefaultFileMode
+	}
+	if o.DirMode == 0 {
+		o.DirMode = DefaultDirMode
+	}
+	if o.SyncInterval == 0 {
+		o.SyncInterval = DefaultSyncInterval
+	}
+	if o.ReapInterval == 0 {
+		o.ReapInterval = DefaultReapInterval
+	}
+	if o.SnapshotInterval == 0 {
+		o.SnapshotInterval = DefaultSnapshotInterval
+	}
+	if o.DiskIndexCache == 0 {
+		o.DiskIndexCache = DefaultDiskIndexCache
+	}
+	if o.Backend == "" {
+		o.Backend = DefaultBackend
+	}
+	if o.ActiveSegments == 0 {
+		o.ActiveSegments = DefaultActiveSegments
+	}
+	if o.Logger == nil {
+		o.Logger = nopLogger{}
+	}
+	return o
+}
+
+// 校验选项, 零值表示使用默认值
+func (o *Options) Validate() error {
+	switch {
+	case o.Max < 0:
+		return &OptionError{Field: "Max", Value: o.Max, Reason: "must not be negative"}
+	case o.SegmentSize < 0:
+		return &OptionError{Field: "SegmentSize", Value: o.SegmentSize, Reason: "must not be negative"}
+	case o.FileMode&^os.ModePerm != 0 || (o.FileMode != 0 && o.FileMode&0600 != 0600):
+		return &OptionError{Field: "FileMode", Value: o.FileMode, Reason: "must be permission bits readable and writable by owner"}
+	case o.DirMode&^os.ModePerm != 0 || (o.DirMode != 0 && o.DirMode&0700 != 0700):
+		return &OptionError{Field: "DirMode", Value: o.DirMode, Reason: "must be permission bits accessible by owner"}
+	case o.Sync < SyncNone || o.Sync > SyncGroup:
+		return &OptionError{Field: "Sync", Value: o.Sync, Reason: "unknown sync mode"}
+	case o.SyncInterval < 0:
+		return &OptionError{Field: "SyncInterval", Value: o.SyncInterval, Reason: "must not be negative"}
+	case o.ReapInterval < 0:
+		return &OptionError{Field: "ReapInterval", Value: o.ReapInterval, Reason: "must not be negative"}
+	case o.SnapshotInterval < 0:
+		return &OptionError{Field: "SnapshotInterval", Value: o.SnapshotInterval, Reason: "must not be negative"}
+	case o.DiskIndexCache < 0:
+		return &OptionError{Field: "DiskIndexCache", Value: o.DiskIndexCache, Reason: "must not be negative"}
+	case o.DiskIndex && o.PackedIndex:
+		return &OptionError{Field: "DiskIndex", Value: o.DiskIndex, Reason: "can not be used with PackedIndex"}
+	case (o.DiskIndex || o.Backend == BackendDiskIndex) && o.NoSnapshot:
+		return &OptionError{Field: "DiskIndex", Value: o.DiskIndex, Reason: "needs index snapshot"}
+	case o.ActiveSegments < 0:
+		return &OptionError{Field: "ActiveSegments", Value: o.ActiveSegments, Reason: "must not be negative"}
+	case o.Placement < PlaceRoundRobin || o.Placement > PlaceHash:
+		return &OptionError{Field: "Placement", Value: o.Placement, Reason: "unknown placement"}
+	case o.ReadOnly && o.Sync != SyncNone:
+		return &OptionError{Field: "Sync", Value: o.Sync, Reason: "read-only store can not sync"}
+	}
+
+	if o.Backend != "" {
+		if _, err := lookupBackend(o.Backend); err != nil {
+			return &OptionError{Field: "Backend", Value: o.Backend, Reason: "not registered"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OptionsValidate(t *testing.T) {
+	for _, opt := range []Options{
+		{Max: -1},
+		{SegmentSize: -1},
+		{FileMode: 0400},
+		{FileMode: os.ModeDir | 0644},
+		{DirMode: 0600},
+		{Sync: SyncGroup + 1},
+		{SyncInterval: -time.Second},
+		{ReadOnly: true, Sync: SyncAlways},
+		{Backend: "no-such-backend"},
+		{Backend: BackendDiskIndex, NoSnapshot: true},
+		{ActiveSegments: -1},
+		{Placement: PlaceHash + 1},
+	} {
+		err := opt.Validate()
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+
+		_, err = OpenWithOptions("./testdata/options", opt)
+		assert.ErrorIs(t, err, ErrInvalidOptions)
+	}
+
+	assert.NoError(t, (&Options{}).Validate())
+}
+
+// 存储引擎第一次写入时才新建, 文件权限按选项, 只读打开不能写
+func Test_OpenWithOptions(t *testing.T) {
+	dir := "./testdata/options"
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB, FileMode: 0600})
+	assert.NoError(t, err)
+	assert.Len(t, s.segments(), 0)
+	_, err = s.Put([]byte("hello"))
+	assert.NoError(t, err)
+	assert.Len(t, s.segments(), 1)
+	assert.NoError(t, s.Close())
+
+	fi, err := os.Stat(dir + "/0.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0600))
+
+	s, err = OpenWithOptions(dir, Options{Max: 4 * MB, SegmentSize: MB, ReadOnly: true})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.Put([]byte("hello"))
+	assert.ErrorIs(t, err, ErrReadOnly)
+	assert.ErrorIs(t, s.Delete("0,0"), ErrReadOnly)
+}
+
+// 同一个目录只能有一个写者, 只读打开不受影响
+func Test_OpenLocked(t *testing.T) {
+	dir := "./testdata/locked"
+	os.RemoveAll(dir)
+
+	s, err := Open(dir, 0)
+	assert.NoError(t, err)
+
+	_, err = Open(dir, 0)
+	assert.ErrorIs(t, err, ErrLocked)
+	var lockErr *LockedError
+	assert.ErrorAs(t, err, &lockErr)
+	assert.Equal(t, lockErr.PID, os.Getpid())
+
+	r, err := OpenWithOptions(dir, Options{ReadOnly: true})
+	assert.NoError(t, err)
+	assert.NoError(t, r.Close())
+
+	assert.NoError(t, s.Close())
+
+	s, err = Open(dir, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 启动时的恢复报告, 没有丢弃任何东西的时候是零值(Name除外)
+// 写入的顺序是idx -> dat -> meta, 任何一步都可能只写了一半:
+// 1. idx尾部的记录不完整或者解码失败, 从这条记录开始截断
+// 2. idx记录指向了dat文件之外, 说明数据没写完, 从这条记录开始截断
+// 3. dat尾部有没被索引指向的数据, 截断
+// 4. meta里的DatOffset和Seq以idx为准修正
+type RecoveryReport struct {
+	Name string
+	// 第一条坏记录的原因
+	Reason string
+	// 从.idx尾部截掉的字节数
+	DroppedIdxBytes int64
+	// 从.dat尾部截掉的字节数
+	DroppedDatBytes int64
+	// .meta最后一行只写了一半
+	TornMeta bool
+	// 修正前后的DatOffset
+	OldDatOffset, NewDatOffset int64
+	// 修正前后的Seq
+	OldSeq, NewSeq int64
+}
+
+// 是否做过恢复
+func (r RecoveryReport) Recovered() bool {
+	return r.Reason != "" || r.DroppedDatBytes > 0 || r.TornMeta ||
+		r.OldDatOffset != r.NewDatOffset || r.OldSeq != r.NewSeq
+}
+
+func (r RecoveryReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "recover %s:", r.Name)
+	if r.Reason != "" {
+		fmt.Fprintf(&b, " %s, drop %d bytes of idx;", r.Reason, r.DroppedIdxBytes)
+	}
+	if r.DroppedDatBytes > 0 {
+		fmt.Fprintf(&b, " drop %d bytes of dat;", r.DroppedDatBytes)
+	}
+	if r.TornMeta {
+		b.WriteString(" torn meta;")
+	}
+	if r.OldDatOffset != r.NewDatOffset {
+		fmt.Fprintf(&b, " DatOffset %d -> %d;", r.OldDatOffset, r.NewDatOffset)
+	}
+	if r.OldSeq != r.NewSeq {
+		fmt.Fprintf(&b, " Seq %d -> %d;", r.OldSeq, r.NewSeq)
+	}
+	return b.String()
+}
+
+// 启动时恢复的情况
+func (i *IndexInMemory) Recovery() RecoveryReport {
+	return i.recovery
+}
+
+// 以idx为准修正dat和元数据, loadIdx之后调用
+func (i *IndexInMemory) reconcile() (err error) {
+	r := &i.recovery
+	r.Name = i.name
+
+	fi, err := i.dat.Stat()
+	if err != nil {
+		return err
+	}
+
+	// 只读打开时, 多出来的数据可能是写进程正在写的, 不能截断
+	if fi.Size() > i.datEnd && !i.opt.ReadOnly {
+		// 数据写了, 但是没有索引指向它
+		r.DroppedDatBytes = fi.Size() - i.datEnd
+		if err = i.dat.Truncate(i.datEnd); err != nil {
+			return err
+		}
+	}
+
+	if i.DatOffset != i.datEnd {
+		r.OldDatOffset, r.NewDatOffset = i.DatOffset, i.datEnd
+		i.TotalSize += i.datEnd - i.DatOffset
+		if i.TotalSize < 0 {
+			i.TotalSize = 0
+		}
+		i.DatOffset = i.datEnd
+	}
+
+	if i.Seq <= i.maxKey {
+		r.OldSeq, r.NewSeq = i.Seq, i.maxKey+1
+		i.Seq = i.maxKey + 1
+	}
+
+	if r.Recovered() {
+		i.updateMetadata()
+	}
+	return nil
+}
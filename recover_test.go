@@ -0,0 +1,160 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func putN(t *testing.T, name string, n int64) {
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	for i := int64(0); i < n; i++ {
+		assert.NoError(t, index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i))))
+	}
+	assert.NoError(t, index.Close())
+}
+
+// idx尾部只写了一半, 截断之后还能打开
+func Test_RecoverTornIdx(t *testing.T) {
+	name := "./testdata/recover_idx"
+	removeIndexFiles(name)
+	putN(t, name, 3)
+
+	fi, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+
+	f, err := os.OpenFile(idxName(name), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{0x10, 0x00})
+	f.Close()
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	r := index.Recovery()
+	assert.True(t, r.Recovered())
+	assert.Equal(t, r.DroppedIdxBytes, int64(2))
+
+	fi2, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), fi2.Size())
+
+	for i := int64(0); i < 3; i++ {
+		elem, ok, err := index.Get(i)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+	}
+}
+
+// 掉电之后idx尾部是填0的块, 不能当成key 0的记录重放
+func Test_RecoverZeroIdxTail(t *testing.T) {
+	name := "./testdata/recover_zero"
+	removeIndexFiles(name)
+	putN(t, name, 1)
+	os.Remove(snapName(name))
+
+	fi, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+
+	f, err := os.OpenFile(idxName(name), os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write(make([]byte, 16))
+	f.Close()
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	r := index.Recovery()
+	assert.True(t, r.Recovered())
+	assert.Equal(t, r.DroppedIdxBytes, int64(16))
+
+	fi2, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), fi2.Size())
+
+	elem, ok, err := index.Get(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, elem.Data, []byte("hello world:0"))
+}
+
+// 最后一条idx记录的内容坏了, crc对不上, 从这条开始截断
+func Test_RecoverBadIdxCrc(t *testing.T) {
+	name := "./testdata/recover_crc"
+	removeIndexFiles(name)
+	putN(t, name, 3)
+	os.Remove(snapName(name))
+
+	fi, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+
+	f, err := os.OpenFile(idxName(name), os.O_RDWR, 0644)
+	assert.NoError(t, err)
+	// 最后一条记录的offset
+	f.WriteAt([]byte{0xff}, fi.Size()-fixedRecordLen+4+8)
+	f.Close()
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	r := index.Recovery()
+	assert.True(t, r.Recovered())
+	assert.Equal(t, r.DroppedIdxBytes, int64(fixedRecordLen))
+
+	_, ok, err := index.Get(2)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for i := int64(0); i < 2; i++ {
+		elem, ok, err := index.Get(i)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+	}
+}
+
+// 最后一条数据没写完, 丢弃它的索引并修正DatOffset
+func Test_RecoverTornDat(t *testing.T) {
+	name := "./testdata/recover_dat"
+	removeIndexFiles(name)
+	putN(t, name, 3)
+
+	fi, err := os.Stat(datName(name))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(datName(name), fi.Size()-2))
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+
+	r := index.Recovery()
+	assert.True(t, r.Recovered())
+	assert.Greater(t, r.DroppedIdxBytes, int64(0))
+	assert.Equal(t, r.OldDatOffset, fi.Size())
+
+	_, ok, err := index.Get(2)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// 修正之后继续写入, 重启之后数据都是对的
+	assert.NoError(t, index.PutWithKey(2, []byte("hello world:2")))
+	assert.NoError(t, index.Close())
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+	assert.False(t, index.Recovery().Recovered())
+
+	for i := int64(0); i < 3; i++ {
+		elem, ok, err := index.Get(i)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+	}
+}
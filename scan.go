@@ -0,0 +1,87 @@
+package storage
+
+// 遍历时返回的文件信息, ID带cookie, 可以直接读取数据
+type FileInfo struct {
+	ID FileID
+	Index
+}
+
+// 按(组号, key)的顺序遍历所有没有过期的数据, fn返回false停止
+// 每个存储引擎在遍历到它的时候拍快照, 遍历期间的写入和删除看不到, 不同的存储引擎不是同一个时刻的快照
+func (g *Group) Scan(fn func(id FileID, index Index) bool) error {
+	return g.ScanFrom(FileID{}, fn)
+}
+
+// 从start开始(包含start)遍历, start的cookie不用填
+func (g *Group) ScanFrom(start FileID, fn func(id FileID, index Index) bool) (err error) {
+	return g.scan(start, 0, fn)
+}
+
+// 最多遍历limit条, limit小于等于0不限, 每个存储引擎只取还差的条数
+func (g *Group) scan(start FileID, limit int, fn func(id FileID, index Index) bool) (err error) {
+	if start.GroupIndex < 0 {
+		start = FileID{}
+	}
+
+	stop, count := false, 0
+	segments := g.segments()
+	for groupIndex := start.GroupIndex; groupIndex < len(segments) && !stop; groupIndex++ {
+		key := int64(0)
+		if groupIndex == start.GroupIndex {
+			key = start.Key
+		}
+
+		left := 0
+		if limit > 0 {
+			if left = limit - count; left <= 0 {
+				break
+			}
+		}
+
+		err = segments[groupIndex].Scan(key, left, func(key int64, index Index) bool {
+			count++
+			stop = !fn(FileID{GroupIndex: groupIndex, Key: key, Cookie: index.Cookie}, index)
+			return !stop
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 分页列出文件, cursor为空从头开始, 返回的next是下一页的cursor, 没有下一页时为空
+// 一页只从存储引擎里取limit+1条, 翻页的开销和页的大小成正比
+func (g *Group) ListFiles(cursor string, limit int) (files []FileInfo, next string, err error) {
+	var start FileID
+	if cursor != "" {
+		if start, err = ParseFileID(cursor); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if limit <= 0 {
+		return nil, "", nil
+	}
+
+	var last FileID
+	more := false
+	// 多取一条看有没有下一页
+	err = g.scan(start, limit+1, func(id FileID, index Index) bool {
+		if len(files) == limit {
+			more = true
+			return false
+		}
+		files = append(files, FileInfo{ID: id, Index: index})
+		last = id
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if more {
+		next = FileID{GroupIndex: last.GroupIndex, Key: last.Key + 1}.String()
+	}
+	return
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 跨存储引擎按顺序遍历, 跳过删除和过期的数据
+func Test_Scan(t *testing.T) {
+	testBackends(t, testScan)
+}
+
+func testScan(t *testing.T, backend string) {
+	dir := "./testdata/scan_" + backend
+	os.RemoveAll(dir)
+
+	s, err := OpenWithOptions(dir, Options{Max: 2 * MB, SegmentSize: MB, Backend: backend})
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var ids []string
+	for _, data := range [][]byte{[]byte("a"), []byte("b"), bytes.Repeat([]byte("c"), int(MB)), []byte("d")} {
+		id, err := s.Put(data)
+		assert.NoError(t, err)
+		ids = append(ids, id)
+	}
+
+	_, err = s.PutWithTTL([]byte("expired"), time.Nanosecond)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Delete(ids[1]))
+	time.Sleep(time.Millisecond)
+
+	var got []string
+	assert.NoError(t, s.Scan(func(id FileID, index Index) bool {
+		got = append(got, id.String())
+		return true
+	}))
+	assert.Equal(t, got, []string{ids[0], ids[2], ids[3]})
+
+	last, err := ParseFileID(ids[3])
+	assert.NoError(t, err)
+	assert.Equal(t, last.GroupIndex, 1)
+
+	// 分页
+	files, next, err := s.ListFiles("", 2)
+	assert.NoError(t, err)
+	assert.Len(t, files, 2)
+	assert.Equal(t, files[1].ID.String(), ids[2])
+	assert.NotEqual(t, next, "")
+
+	files, next, err = s.ListFiles(next, 2)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, files[0].ID.String(), ids[3])
+	assert.Equal(t, next, "")
+
+	// 一页一页翻完和一次遍历的结果一样
+	for n := 0; n < 20; n++ {
+		_, err = s.Put([]byte("e"))
+		assert.NoError(t, err)
+	}
+	var scanned, paged []string
+	assert.NoError(t, s.Scan(func(id FileID, index Index) bool {
+		scanned = append(scanned, id.String())
+		return true
+	}))
+	for cursor := ""; ; {
+		page, next, err := s.ListFiles(cursor, 3)
+		assert.NoError(t, err)
+		for _, f := range page {
+			paged = append(paged, f.ID.String())
+		}
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	assert.Len(t, scanned, 23)
+	assert.Equal(t, paged, scanned)
+
+	// 列表里的id带cookie, 可以直接读
+	elem, ok, err := s.Get(files[0].ID.String())
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "d")
+}
@@ -0,0 +1,527 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+)
+
+// 索引快照(hint文件)
+// 把索引按key排序写到.snap文件, 启动时先加载快照, 再从快照记录的idxOffset开始重放idx的尾部,
+// 不用重放整个idx. 快照在Close和每隔Options.SnapshotInterval写一次, 先写临时文件再rename.
+// 磁盘索引(Options.DiskIndex)不把快照加载到内存, 直接在快照上二分查找, 见disk_index.go
+//
+// 格式, 小端, 开头是64个字节的头:
+// 0  4个字节的magic "SNAP"
+// 4  4个字节的版本号
+// 8  8个字节的idxOffset, 快照包含了idx里这个位置之前的所有记录
+// 16 4个字节的idx尾部校验, idxOffset之前最多64个字节的crc32, 防止快照和idx不是一对
+// 20 8个字节的datEnd
+// 28 8个字节的maxKey
+// 36 8个字节的旧版本记录个数
+// 44 8个字节的条目个数
+// 52 8个字节的有过期时间的条目个数
+// 60 4个字节的crc32, 校验前面的60个字节
+// 然后是4KB一页的条目, 每页78条, 每条都是一个定长的idx记录(见idx_codec.go), 按key排序,
+// 每页最后4个字节是这一页的crc32
+// 最后是有过期时间的key, 每个8个字节, 按key排序, 后面跟4个字节的crc32
+//
+// 压缩和迁移替换idx之前先删除快照, 替换之后的第一次快照才会重新写, 磁盘索引替换之后马上写
+
+const (
+	snapMagic       = "SNAP"
+	snapVersion     = 2
+	snapHeaderLen   = 64
+	snapPageSize    = 4096
+	snapPageEntries = (snapPageSize - 4) / fixedRecordLen
+	snapTailLen     = 64
+	snapTmpSuffix   = ".tmp"
+)
+
+var ErrBadSnapshot = errors.New("bad index snapshot")
+
+// 快照的头
+type snapHeader struct {
+	idxOffset  int64
+	tailCrc    uint32
+	datEnd     int64
+	maxKey     int64
+	oldRecords int
+	count      int64
+	ttlCount   int64
+}
+
+func (h *snapHeader) encode(buf []byte) {
+	copy(buf, snapMagic)
+	binary.LittleEndian.PutUint32(buf[4:], snapVersion)
+	binary.LittleEndian.PutUint64(buf[8:], uint64(h.idxOffset))
+	binary.LittleEndian.PutUint32(buf[16:], h.tailCrc)
+	binary.LittleEndian.PutUint64(buf[20:], uint64(h.datEnd))
+	binary.LittleEndian.PutUint64(buf[28:], uint64(h.maxKey))
+	binary.LittleEndian.PutUint64(buf[36:], uint64(h.oldRecords))
+	binary.LittleEndian.PutUint64(buf[44:], uint64(h.count))
+	binary.LittleEndian.PutUint64(buf[52:], uint64(h.ttlCount))
+	binary.LittleEndian.PutUint32(buf[60:], crc32.ChecksumIEEE(buf[:60]))
+}
+
+func (h *snapHeader) decode(buf []byte) error {
+	if string(buf[:4]) != snapMagic {
+		return fmt.Errorf("%w:bad magic", ErrBadSnapshot)
+	}
+
+	if v := binary.LittleEndian.Uint32(buf[4:]); v != snapVersion {
+		return fmt.Errorf("%w:version(%d)", ErrBadSnapshot, v)
+	}
+
+	if crc32.ChecksumIEEE(buf[:60]) != binary.LittleEndian.Uint32(buf[60:]) {
+		return fmt.Errorf("%w:header crc mismatch", ErrBadSnapshot)
+	}
+
+	h.idxOffset = int64(binary.LittleEndian.Uint64(buf[8:]))
+	h.tailCrc = binary.LittleEndian.Uint32(buf[16:])
+	h.datEnd = int64(binary.LittleEndian.Uint64(buf[20:]))
+	h.maxKey = int64(binary.LittleEndian.Uint64(buf[28:]))
+	h.oldRecords = int(binary.LittleEndian.Uint64(buf[36:]))
+	h.count = int64(binary.LittleEndian.Uint64(buf[44:]))
+	h.ttlCount = int64(binary.LittleEndian.Uint64(buf[52:]))
+	if h.count < 0 || h.ttlCount < 0 || h.ttlCount > h.count {
+		return fmt.Errorf("%w:count(%d) ttl(%d)", ErrBadSnapshot, h.count, h.ttlCount)
+	}
+	return nil
+}
+
+// 条目占用的页数
+func (h *snapHeader) pages() int64 {
+	return (h.count + snapPageEntries - 1) / snapPageEntries
+}
+
+// 有过期时间的key的开始位置
+func (h *snapHeader) ttlOffset() int64 {
+	return snapHeaderLen + h.pages()*snapPageSize
+}
+
+// 文件的总长度
+func (h *snapHeader) size() int64 {
+	return h.ttlOffset() + h.ttlCount*8 + 4
+}
+
+// 校验一页
+func checkSnapPage(page []byte, n int64) error {
+	if crc32.ChecksumIEEE(page[:snapPageSize-4]) != binary.LittleEndian.Uint32(page[snapPageSize-4:]) {
+		return fmt.Errorf("%w:page %d crc mismatch", ErrBadSnapshot, n)
+	}
+	return nil
+}
+
+// 解码页里的第n条
+func decodeSnapEntry(page []byte, n int) (key int64, index Index, err error) {
+	off := n * fixedRecordLen
+	key, index, deleted, err := decodeFixed(page[off+4 : off+fixedRecordLen])
+	if err == nil && deleted {
+		err = fmt.Errorf("%w:tombstone in snapshot", ErrBadSnapshot)
+	}
+	return
+}
+
+// 流式写快照, 条目要按key从小到大加进来
+type snapWriter struct {
+	f    *os.File
+	w    *bufio.Writer
+	page [snapPageSize]byte
+	n    int
+	h    snapHeader
+	ttl  []int64
+}
+
+func newSnapWriter(name string, h snapHeader, perm os.FileMode) (s *snapWriter, err error) {
+	s = &snapWriter{h: h}
+	if s.f, err = os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, perm); err != nil {
+		return nil, err
+	}
+
+	// 头最后写, 条目个数写完才知道
+	s.w = bufio.NewWriterSize(s.f, 16*snapPageSize)
+	if _, err = s.w.Write(make([]byte, snapHeaderLen)); err != nil {
+		s.f.Close()
+		return nil, err
+	}
+	s.h.count, s.h.ttlCount = 0, 0
+	return s, nil
+}
+
+func (s *snapWriter) add(key int64, index *Index) error {
+	encodeFixed(s.page[s.n*fixedRecordLen:], key, index, 0)
+	s.n++
+	s.h.count++
+	if index.Timeout != 0 {
+		s.ttl = append(s.ttl, key)
+	}
+
+	if s.n == snapPageEntries {
+		return s.flushPage()
+	}
+	return nil
+}
+
+func (s *snapWriter) flushPage() error {
+	binary.LittleEndian.PutUint32(s.page[snapPageSize-4:], crc32.ChecksumIEEE(s.page[:snapPageSize-4]))
+	if _, err := s.w.Write(s.page[:]); err != nil {
+		return err
+	}
+	s.page = [snapPageSize]byte{}
+	s.n = 0
+	return nil
+}
+
+// 写完剩下的页, 有过期时间的key和头, 然后刷盘
+func (s *snapWriter) finish() (err error) {
+	defer func() {
+		if e := s.f.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	if s.n > 0 {
+		if err = s.flushPage(); err != nil {
+			return err
+		}
+	}
+
+	s.h.ttlCount = int64(len(s.ttl))
+	buf := make([]byte, len(s.ttl)*8+4)
+	for n, key := range s.ttl {
+		binary.LittleEndian.PutUint64(buf[n*8:], uint64(key))
+	}
+	binary.LittleEndian.PutUint32(buf[len(buf)-4:], crc32.ChecksumIEEE(buf[:len(buf)-4]))
+	if _, err = s.w.Write(buf); err != nil {
+		return err
+	}
+
+	if err = s.w.Flush(); err != nil {
+		return err
+	}
+
+	var head [snapHeaderLen]byte
+	s.h.encode(head[:])
+	if _, err = s.f.WriteAt(head[:], 0); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// 读有过期时间的key
+func readSnapTTL(f *os.File, h *snapHeader) ([]int64, error) {
+	buf := make([]byte, h.ttlCount*8+4)
+	if _, err := f.ReadAt(buf, h.ttlOffset()); err != nil {
+		return nil, fmt.Errorf("%w:read ttl keys:%s", ErrBadSnapshot, err)
+	}
+
+	end := len(buf) - 4
+	if crc32.ChecksumIEEE(buf[:end]) != binary.LittleEndian.Uint32(buf[end:]) {
+		return nil, fmt.Errorf("%w:ttl keys crc mismatch", ErrBadSnapshot)
+	}
+
+	keys := make([]int64, h.ttlCount)
+	for n := range keys {
+		keys[n] = int64(binary.LittleEndian.Uint64(buf[n*8:]))
+	}
+	return keys, nil
+}
+
+// 能写快照的索引表
+type snapshotTable interface {
+	// 拍快照, 需要持有写锁, 返回的函数不持有锁按key从小到大遍历快照
+	freeze() func(fn func(key int64, index *Index) error) error
+	// 快照写完了(ok为true)或者失败了, 需要持有写锁
+	thaw(name string, ok bool) error
+	// 从快照加载
+	load(f *os.File, h *snapHeader) error
+	// 是否值得写一次快照
+	dirty() bool
+}
+
+func (m mapTable) freeze() func(fn func(key int64, index *Index) error) error {
+	items := make([]compactItem, 0, len(m))
+	for key, index := range m {
+		items = append(items, compactItem{key: key, Index: index})
+	}
+
+	return func(fn func(key int64, index *Index) error) error {
+		sort.Slice(items, func(a, b int) bool {
+			return items[a].key < items[b].key
+		})
+
+		for n := range items {
+			if err := fn(items[n].key, &items[n].Index); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (m mapTable) thaw(name string, ok bool) error {
+	return nil
+}
+
+// 把整个快照读到map里
+func (m mapTable) load(f *os.File, h *snapHeader) error {
+	buf := make([]byte, h.ttlOffset()-snapHeaderLen)
+	if _, err := f.ReadAt(buf, snapHeaderLen); err != nil {
+		return fmt.Errorf("%w:%s", ErrBadSnapshot, err)
+	}
+
+	if _, err := readSnapTTL(f, h); err != nil {
+		return err
+	}
+
+	for n := int64(0); n < h.count; n++ {
+		p := n / snapPageEntries
+		page := buf[p*snapPageSize : (p+1)*snapPageSize]
+		if n%snapPageEntries == 0 {
+			if err := checkSnapPage(page, p); err != nil {
+				return err
+			}
+		}
+
+		key, index, err := decodeSnapEntry(page, int(n%snapPageEntries))
+		if err != nil {
+			return fmt.Errorf("%w:entry %d:%s", ErrBadSnapshot, n, err)
+		}
+		m[key] = index
+	}
+	return nil
+}
+
+func (m mapTable) dirty() bool {
+	return true
+}
+
+// 生成快照文件名
+func snapName(fileName string) string {
+	return fmt.Sprintf("%s.snap", fileName)
+}
+
+// 删除快照, 替换idx之前调用
+func removeSnapshot(name string) error {
+	os.Remove(snapName(name) + snapTmpSuffix)
+	if err := os.Remove(snapName(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 紧凑的索引要知道每条记录在idx里的位置, 快照里没有, 所以不用快照
+func (i *IndexInMemory) useSnapshot() bool {
+	return !i.opt.NoSnapshot && !i.opt.PackedIndex
+}
+
+// idx里[offset-64, offset)的crc32
+func (i *IndexInMemory) idxTailCrc(offset int64) (uint32, error) {
+	start := offset - snapTailLen
+	if start < 0 {
+		start = 0
+	}
+
+	buf := make([]byte, offset-start)
+	if _, err := i.idx.ReadAt(buf, start); err != nil {
+		return 0, err
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// 定时和关闭的时候写快照, 磁盘索引只在攒了足够多的变化时才重写
+// 需要持有compactMu
+func (i *IndexInMemory) autoSnapshot() error {
+	if i.opt.ReadOnly || !i.useSnapshot() {
+		return nil
+	}
+
+	// 压缩和迁移之后旧的快照删掉了
+	i.rwmu.RLock()
+	dirty := i.snapOffset < 0 || i.allIndex.(snapshotTable).dirty()
+	i.rwmu.RUnlock()
+	if !dirty {
+		return nil
+	}
+	return i.snapshot()
+}
+
+// 写快照, idx没有变化的时候什么都不做
+// 需要持有compactMu, 防止写快照的时候idx被替换
+func (i *IndexInMemory) snapshot() (err error) {
+	if i.opt.ReadOnly || !i.useSnapshot() {
+		return nil
+	}
+
+	i.rwmu.Lock()
+	offset := i.idxOffset
+	if offset == i.snapOffset {
+		i.rwmu.Unlock()
+		return nil
+	}
+
+	table := i.allIndex.(snapshotTable)
+	h := snapHeader{idxOffset: offset, datEnd: i.datEnd, maxKey: i.maxKey, oldRecords: i.oldRecords}
+	each := table.freeze()
+	i.rwmu.Unlock()
+
+	tmp := snapName(i.name) + snapTmpSuffix
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(tmp)
+		}
+
+		i.rwmu.Lock()
+		defer i.rwmu.Unlock()
+		if e := table.thaw(snapName(i.name), ok); e != nil && err == nil {
+			err = e
+		}
+
+		if ok && err == nil {
+			i.snapOffset = offset
+			// 元数据每次写入都追加一行, 启动时要读完整个文件, 顺便重写成一行
+			err = i.rewriteMeta()
+		}
+	}()
+
+	// 快照不能包含没有落盘的idx记录
+	if err = i.idx.Sync(); err != nil {
+		return err
+	}
+
+	if h.tailCrc, err = i.idxTailCrc(offset); err != nil {
+		return err
+	}
+
+	w, err := newSnapWriter(tmp, h, i.opt.FileMode)
+	if err != nil {
+		return err
+	}
+
+	if err = each(w.add); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	if err = w.finish(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, snapName(i.name)); err != nil {
+		return err
+	}
+	if err = syncDir(i.name); err != nil {
+		return err
+	}
+	ok = true
+	return nil
+}
+
+// 把.meta重写成只有当前的一行, 需要持有写锁
+func (i *IndexInMemory) rewriteMeta() (err error) {
+	name := metaName(i.name)
+	tmp := name + snapTmpSuffix
+	md, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, i.opt.FileMode)
+	if err != nil {
+		return err
+	}
+
+	enMd := json.NewEncoder(md)
+	if err = enMd.Encode(&i.metadata); err == nil {
+		err = md.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, name)
+	}
+	if err != nil {
+		md.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	// 已经rename了, 目录没有刷成功也要换成新的文件
+	i.md.Close()
+	i.md, i.enMd = md, enMd
+	return syncDir(name)
+}
+
+// 加载快照, 没有快照返回false, 快照坏了或者和idx/dat对不上返回ErrBadSnapshot
+// 成功之后loadIdx从i.idxOffset开始重放
+func (i *IndexInMemory) loadSnapshot() (ok bool, err error) {
+	f, err := os.Open(snapName(i.name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	defer func() {
+		// 磁盘索引打开成功之后文件归它管
+		if !ok || !i.opt.DiskIndex {
+			f.Close()
+		}
+	}()
+
+	var head [snapHeaderLen]byte
+	if _, err = io.ReadFull(f, head[:]); err != nil {
+		return false, fmt.Errorf("%w:%s", ErrBadSnapshot, err)
+	}
+
+	var h snapHeader
+	if err = h.decode(head[:]); err != nil {
+		return false, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() != h.size() {
+		return false, fmt.Errorf("%w:size(%d) expect(%d)", ErrBadSnapshot, fi.Size(), h.size())
+	}
+
+	// 快照之后idx被截断或者替换了
+	if fi, err = i.idx.Stat(); err != nil {
+		return false, err
+	}
+	if h.idxOffset > fi.Size() {
+		return false, fmt.Errorf("%w:idxOffset(%d) past the end of idx(%d)", ErrBadSnapshot, h.idxOffset, fi.Size())
+	}
+
+	crc, err := i.idxTailCrc(h.idxOffset)
+	if err != nil {
+		return false, err
+	}
+	if crc != h.tailCrc {
+		return false, fmt.Errorf("%w:idx mismatch", ErrBadSnapshot)
+	}
+
+	if fi, err = i.dat.Stat(); err != nil {
+		return false, err
+	}
+	if h.datEnd > fi.Size() {
+		return false, fmt.Errorf("%w:datEnd(%d) past the end of dat(%d)", ErrBadSnapshot, h.datEnd, fi.Size())
+	}
+
+	table := newIndexTable(&i.opt, i.idx, int(h.count))
+	if err = table.(snapshotTable).load(f, &h); err != nil {
+		return false, err
+	}
+
+	i.allIndex = table
+	i.idxOffset = h.idxOffset
+	i.snapOffset = h.idxOffset
+	i.datEnd = h.datEnd
+	i.maxKey = h.maxKey
+	i.oldRecords = h.oldRecords
+	return true, nil
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 加载旧的快照, 快照之后的写入和删除从idx尾部重放回来
+func Test_SnapshotTail(t *testing.T) {
+	name := "./testdata/snapshot_tail"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+
+	for i := int64(0); i < 10; i++ {
+		assert.NoError(t, index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i))))
+	}
+	assert.NoError(t, index.snapshot())
+	snap, err := os.ReadFile(snapName(name))
+	assert.NoError(t, err)
+
+	// 快照之后的写入和删除
+	for i := int64(10); i < 15; i++ {
+		assert.NoError(t, index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i))))
+	}
+	assert.NoError(t, index.Delete(3))
+	assert.NoError(t, index.Close())
+
+	// 换回旧的快照, 相当于快照之后没来得及再写一次
+	assert.NoError(t, os.WriteFile(snapName(name), snap, 0644))
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	assert.Equal(t, index.snapOffset, int64(10*fixedRecordLen))
+	assert.False(t, index.Recovery().Recovered())
+	for i := int64(0); i < 15; i++ {
+		elem, ok, err := index.Get(i)
+		assert.NoError(t, err)
+		assert.Equal(t, ok, i != 3)
+		if ok {
+			assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", i)))
+		}
+	}
+
+	key, err := index.Put([]byte("next"))
+	assert.NoError(t, err)
+	assert.Equal(t, key, int64(15))
+}
+
+// 快照坏了或者和idx对不上的时候不用它, 重放整个idx
+func Test_SnapshotBad(t *testing.T) {
+	name := "./testdata/snapshot_bad"
+	removeIndexFiles(name)
+	putN(t, name, 10)
+
+	snap, err := os.ReadFile(snapName(name))
+	assert.NoError(t, err)
+
+	check := func(bad []byte) {
+		assert.NoError(t, os.WriteFile(snapName(name), bad, 0644))
+		var logs bytes.Buffer
+		opt := testOptions
+		opt.Logger = log.New(&logs, "", 0)
+		index, err := openIndexInMemory(name, &opt)
+		assert.NoError(t, err)
+		defer index.Close()
+
+		assert.Contains(t, logs.String(), ErrBadSnapshot.Error())
+		assert.Equal(t, index.allIndex.len(), 10)
+		for i := int64(0); i < 10; i++ {
+			_, ok, err := index.Get(i)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	}
+
+	// 头部crc不对
+	bad := append([]byte(nil), snap...)
+	bad[10] ^= 0xff
+	check(bad)
+
+	// 页crc不对, 内存索引加载时就能发现, 磁盘索引读到这一页才发现
+	bad = append([]byte(nil), snap...)
+	bad[snapHeaderLen+10] ^= 0xff
+	if testOptions.DiskIndex {
+		assert.NoError(t, os.WriteFile(snapName(name), bad, 0644))
+		index, err := newIndexInMemory(name)
+		assert.NoError(t, err)
+		_, _, err = index.Get(0)
+		assert.ErrorIs(t, err, ErrBadData)
+		assert.NoError(t, index.Close())
+	} else {
+		check(bad)
+	}
+
+	// idx被截断了
+	assert.NoError(t, os.WriteFile(snapName(name), snap, 0644))
+	fi, err := os.Stat(idxName(name))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(idxName(name), fi.Size()-fixedRecordLen))
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	assert.Equal(t, index.allIndex.len(), 9)
+	assert.NoError(t, index.Close())
+}
+
+// 压缩替换idx之后旧的快照被删除, 磁盘索引换成新的
+func Test_SnapshotCompact(t *testing.T) {
+	name := "./testdata/snapshot_compact"
+	removeIndexFiles(name)
+	putN(t, name, 10)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	for i := int64(0); i < 10; i += 2 {
+		assert.NoError(t, index.Delete(i))
+	}
+
+	// 磁盘索引压缩之后马上写了新的快照
+	assert.NoError(t, index.Compact())
+	_, err = os.Stat(snapName(name))
+	assert.Equal(t, os.IsNotExist(err), !testOptions.DiskIndex)
+	assert.Equal(t, index.snapOffset == index.idxOffset, testOptions.DiskIndex)
+	assert.NoError(t, index.Close())
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+	assert.Equal(t, index.snapOffset, index.idxOffset)
+	assert.Equal(t, index.allIndex.len(), 5)
+}
+
+// 马上要删除的存储引擎关闭时不写快照
+func Test_DiscardNoSnapshot(t *testing.T) {
+	name := "./testdata/snapshot_discard"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	assert.NoError(t, index.PutWithKey(1, []byte("hello")))
+	assert.NoError(t, index.Discard())
+
+	_, err = os.Stat(snapName(name))
+	assert.True(t, os.IsNotExist(err))
+}
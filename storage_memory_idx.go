@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/antlabs/deepcopy"
 	"google.golang.org/protobuf/proto"
@@ -23,25 +25,71 @@ import (
 // 4个字节的size
 // 4个字节的crc32
 // 8个字节的过期时间
+// 4个字节的cookie, 4个字节的元数据长度, 4个字节的标志位, 见idx_codec.go
+//
+// payload长度的高8位是记录类型(也就是记录的版本), 低24位才是真正的长度
+// 新写入的都是recordIdxFixed, 旧版本的记录还能读, 可以用storage migrate重写成新版本
+
+// idx记录类型
+const (
+	recordIdxVersion0 = 0 // 旧版本的写入记录, 内容是IdxVersion0
+	recordTombstone   = 1 // 旧版本的删除记录, 内容是IdxTombstone
+	recordIdxVersion1 = 2 // 写入和删除记录, 内容是IdxVersion1
+	recordIdxFixed    = 3 // 定长的写入和删除记录, 见idx_codec.go
+
+	// 新写入的记录类型
+	recordCurrent = recordIdxFixed
+
+	recordTypeShift = 24
+	recordLenMask   = 1<<recordTypeShift - 1
+)
+
+// IdxVersion1和定长记录的标志位
+const (
+	idxFlagTombstone  = 1 << 0 // 删除记录
+	idxFlagCompressed = 1 << 1 // 数据是压缩过的, 还没有实现, 读到了报错
+
+	idxFlagKnown = idxFlagTombstone | idxFlagCompressed
+)
 
 var (
-	_            Storager = (*IndexInMemory)(nil)
-	defaultTable          = crc32.MakeTable(0xD5828281)
-	maxDatLimit           = 32 * GB
-	payload               = 4
-	ErrFull               = errors.New("The space is full")
+	_             Storager = (*IndexInMemory)(nil)
+	defaultTable           = crc32.MakeTable(0xD5828281)
+	payload                = 4
+	ErrFull                = errors.New("The space is full")
+	ErrObjectSize          = errors.New("illegal object size")
+	ErrBadData             = errors.New("The data file is bad")
+	ErrRange               = errors.New("range not satisfiable")
+	ErrKeyExists           = errors.New("key already exists")
+	// idx里有不认识的记录类型或者标志位, 可能是新版本写的
+	ErrUnknownRecord = errors.New("unknown idx record")
 )
 
 type Index struct {
-	Key     int32  `protobuf:"varint,1,opt,name=key,proto3" json:"key,omitempty"`         //返回给客户端的值
+	Key     int64  `protobuf:"varint,1,opt,name=key,proto3" json:"key,omitempty"`         //返回给客户端的值
 	Size    int32  `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`       //大小
 	Offset  int64  `protobuf:"varint,3,opt,name=offset,proto3" json:"offset,omitempty"`   //偏移量
-	Timeout int64  `protobuf:"varint,4,opt,name=timeout,proto3" json:"timeout,omitempty"` //超时时间
+	Timeout int64  `protobuf:"varint,4,opt,name=timeout,proto3" json:"timeout,omitempty"` //超时时间, unix纳秒, 0表示永不过期
 	Crc32   uint32 `protobuf:"varint,5,opt,name=crc32,proto3" json:"crc32,omitempty"`     //crc32校验和
+	Cookie  uint32 `protobuf:"varint,6,opt,name=cookie,proto3" json:"cookie,omitempty"`   //随机数, 和key一起组成对外的文件id
+	// 元数据的长度, 元数据放在数据文件里Offset前面
+	MetaSize int32 `protobuf:"varint,7,opt,name=meta_size,proto3" json:"meta_size,omitempty"`
+}
+
+// 是否已经过期
+func (i *Index) expired(now int64) bool {
+	return i.Timeout != 0 && i.Timeout <= now
+}
+
+// 在数据文件里占用的空间, 包括元数据
+func (i *Index) diskSize() int64 {
+	return int64(i.MetaSize) + int64(i.Size)
 }
 
 type Data struct {
 	Index
+	// 元数据, 写入时没有设置为nil
+	Meta *Metadata `json:"meta,omitempty"`
 	Data []byte
 }
 
@@ -58,10 +106,13 @@ type metadata struct {
 	Readonly bool
 	//最后一个offset, 需要持久化到文件中
 	DatOffset int64
+	// 被删除数据的总字节数, 用于计算垃圾率, 需要持久化到文件中
+	DeleteSize int64
 }
 
 // 一个内存索引管理32GB文件
 type IndexInMemory struct {
+	name string   //文件名前缀, 不包含后缀
 	idx  *os.File //索引文件
 	dat  *os.File //数据文件
 	md   *os.File //元数据文件
@@ -74,8 +125,35 @@ type IndexInMemory struct {
 
 	metadata
 
-	// sync.Map没有Len比较蛋疼，所以这里还是map+读写锁
-	allIndex map[int64]Index
+	// key到索引的映射, 默认是map, Options.PackedIndex为true时用紧凑的表示
+	allIndex indexTable
+	// 已经分配了key, 还在写数据的Put, 防止同一个key被写两次
+	pending map[int64]struct{}
+
+	// 同一时间只允许一个压缩任务
+	compactMu sync.Mutex
+	// 正在写数据文件的Put持有读锁, 压缩替换文件之前加写锁
+	writeMu sync.RWMutex
+	// 刷盘时持有读锁, 替换和关闭idx/dat文件时加写锁, 刷盘不用持有rwmu
+	fileMu sync.RWMutex
+
+	// 重放idx时看到的最大的数据结尾和最大的key, 用于修正元数据
+	datEnd int64
+	maxKey int64
+	// 重放时看到的旧版本记录的个数, 不为0时可以迁移
+	oldRecords int
+	// 上一次快照时的idxOffset, 没有变化就不用再写快照
+	snapOffset int64
+	// 启动时恢复的情况
+	recovery RecoveryReport
+
+	opt Options
+	// 组提交
+	gc *groupCommit
+	// 停止定时刷盘
+	stopSync func()
+	// 停止定时快照
+	stopSnap func()
 }
 
 // 生成索引文件名
@@ -93,61 +171,146 @@ func metaName(fileName string) string {
 	return fmt.Sprintf("%s.meta", fileName)
 }
 
-func newIndexInMemory(fileName string) (idx *IndexInMemory, err error) {
+// 只读打开或者写入失败之后不能再写
+var ErrReadOnly = errors.New("storage is read-only")
+
+func openIndexInMemory(fileName string, opt *Options) (idx *IndexInMemory, err error) {
 	var memIndex IndexInMemory
 
-	memIndex.allIndex = make(map[int64]Index, 10)
+	memIndex.name = fileName
+	memIndex.opt = opt.withDefaults()
+	memIndex.gc = newGroupCommit()
+	memIndex.pending = make(map[int64]struct{})
+	memIndex.maxKey = -1
+
+	// 上次压缩如果中途退出, 先把文件恢复到一致的状态
+	// 只读打开不能修改文件, 交给写的进程去恢复
+	compacted := false
+	if !memIndex.opt.ReadOnly {
+		if compacted, err = recoverCompact(fileName); err != nil {
+			return nil, fmt.Errorf("recoverCompact:%w", err)
+		}
+		removeMigrateTmp(fileName)
+	}
 
-	// 打开并加载索引文件
-	if err = memIndex.loadIdx(fileName); err != nil {
-		return nil, fmt.Errorf("loadIdx:%w", err)
+	// 先打开索引文件, 只读打开时会加共享锁, 保证和数据文件是一对
+	if err = memIndex.openIdx(fileName); err != nil {
+		return nil, fmt.Errorf("openIdx:%w", err)
 	}
 
 	// 打开数据文件
 	if err = memIndex.loadDat(fileName); err != nil {
+		memIndex.idx.Close()
 		return nil, fmt.Errorf("loadDat:%w", err)
 	}
+	memIndex.allIndex = newIndexTable(&memIndex.opt, memIndex.idx, 10)
+
+	// 先加载快照, 只重放快照之后的idx, 快照不能用就重放整个idx
+	if memIndex.useSnapshot() {
+		if _, err = memIndex.loadSnapshot(); err != nil {
+			memIndex.opt.Logger.Printf("load snapshot %s:%s", fileName, err)
+		}
+	}
+
+	// 加载索引文件
+	if err = memIndex.loadIdx(); err != nil {
+		return nil, fmt.Errorf("loadIdx:%w", err)
+	}
 
 	// 打开元数据文件
 	if err = memIndex.loadMeta(fileName); err != nil {
 		return nil, fmt.Errorf("loadMeta:%w", err)
 	}
 
+	if compacted {
+		// 压缩完成了文件替换, 但是元数据还是旧的
+		if err = memIndex.resetMetadata(); err != nil {
+			return nil, fmt.Errorf("resetMetadata:%w", err)
+		}
+		memIndex.updateMetadata()
+	}
+
+	// 根据idx和dat修正元数据
+	if err = memIndex.reconcile(); err != nil {
+		return nil, fmt.Errorf("reconcile:%w", err)
+	}
+
+	if memIndex.opt.Sync == SyncInterval {
+		memIndex.stopSync = runEvery(memIndex.opt.SyncInterval, func(time.Time) {
+			memIndex.sync()
+		})
+	}
+
+	// 加载时写进小map的部分合并成数组
+	memIndex.allIndex.seal()
+
+	// 磁盘索引重放的部分都在内存里, 马上写成查找文件
+	if memIndex.opt.DiskIndex {
+		if err = memIndex.autoSnapshot(); err != nil {
+			memIndex.opt.Logger.Printf("snapshot %s:%s", fileName, err)
+		}
+	}
+
+	if !memIndex.opt.ReadOnly && memIndex.useSnapshot() {
+		memIndex.stopSnap = runEvery(memIndex.opt.SnapshotInterval, func(time.Time) {
+			// 压缩或者迁移的时候跳过, 它们做完之后idx是新的
+			if !memIndex.compactMu.TryLock() {
+				return
+			}
+			defer memIndex.compactMu.Unlock()
+
+			if err := memIndex.autoSnapshot(); err != nil {
+				memIndex.opt.Logger.Printf("snapshot %s:%s", fileName, err)
+			}
+		})
+	}
+
 	return &memIndex, nil
 }
 
 // 加载元数据
 func (i *IndexInMemory) loadMeta(name string) (err error) {
 	name = metaName(name)
-	i.md, err = os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	i.md, err = os.OpenFile(name, i.openFlag(), i.opt.FileMode)
 	if err != nil {
 		return err
 	}
 
 	r := bufio.NewReader(i.md)
 
-	var prev []byte
+	var prev, last []byte
 	for {
 		l, e := r.ReadBytes('\n')
 		if len(l) == 0 && e != nil {
 			break
 		}
-		prev = l
+		prev, last = last, l
 	}
 
-	if len(prev) > 0 {
-		err = json.Unmarshal(prev, &i.metadata)
-		if err != nil {
-			return err
+	if len(last) > 0 {
+		// 最后一行可能只写了一半, 用上一行
+		if err = json.Unmarshal(last, &i.metadata); err != nil {
+			i.recovery.TornMeta = true
+			i.metadata = metadata{}
+			if len(prev) > 0 {
+				if err = json.Unmarshal(prev, &i.metadata); err != nil {
+					return err
+				}
+			}
+			err = nil
 		}
 	}
 
+	if i.opt.ReadOnly {
+		return
+	}
+
 	if i.Readonly {
 
 		i.md.Close()
 
 		tmpFile := name + ".tmp"
-		i.md, err = os.OpenFile(tmpFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+		i.md, err = os.OpenFile(tmpFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, i.opt.FileMode)
 
 		err = os.Rename(tmpFile, name)
 	}
@@ -156,50 +319,240 @@ func (i *IndexInMemory) loadMeta(name string) (err error) {
 	return
 }
 
-func (i *IndexInMemory) loadIdx(name string) (err error) {
-	// 打开索引文件
-	i.idx, err = os.OpenFile(idxName(name), os.O_CREATE|os.O_RDWR, 0644)
+// 打开文件的flag, 只读打开时不创建文件
+func (i *IndexInMemory) openFlag() int {
+	if i.opt.ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_CREATE | os.O_RDWR
+}
+
+// 打开索引文件
+// 只读打开时加共享锁, 压缩替换文件的时候会对新旧索引文件加排他锁,
+// 所以拿到锁之后路径还指向这个文件, 说明打开的是替换之前或者替换完成之后的一对文件
+func (i *IndexInMemory) openIdx(name string) (err error) {
+	for {
+		i.idx, err = os.OpenFile(idxName(name), i.openFlag(), i.opt.FileMode)
+		if err != nil || !i.opt.ReadOnly {
+			return err
+		}
+
+		if err = lockShared(i.idx); err != nil {
+			i.idx.Close()
+			return err
+		}
+
+		fi, err := i.idx.Stat()
+		if err != nil {
+			i.idx.Close()
+			return err
+		}
+
+		fi2, err := os.Stat(idxName(name))
+		if err == nil && os.SameFile(fi, fi2) {
+			return nil
+		}
+
+		// 加锁期间文件被压缩替换了, 重新打开
+		i.idx.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+}
+
+func (i *IndexInMemory) loadIdx() (err error) {
+	fi, err := i.dat.Stat()
 	if err != nil {
 		return err
 	}
+	datSize := fi.Size()
 
-	head := uint32(0)
-	defer func() {
+	// 顺序读, 记录的buf复用, 解码的时候不能保存buf里的切片
+	// 加载了快照时从快照之后开始
+	r := bufio.NewReaderSize(io.NewSectionReader(i.idx, i.idxOffset, math.MaxInt64-i.idxOffset), 256*1024)
+	var head [4]byte
+	var buf []byte
+	for {
+
+		_, err := io.ReadFull(r, head[:])
 		if err == io.EOF {
-			err = nil
+			break
 		}
-	}()
 
-	for {
+		if err == io.ErrUnexpectedEOF {
+			i.recovery.Reason = "torn idx header"
+			break
+		}
 
-		err = binary.Read(i.idx, binary.LittleEndian, &head)
 		if err != nil {
-			return
+			return err
+		}
+
+		h := binary.LittleEndian.Uint32(head[:])
+		// 掉电之后文件尾部常常是填0的块, 正常写入的记录长度不会是0
+		if h&recordLenMask == 0 {
+			i.recovery.Reason = "zero-filled idx record"
+			break
+		}
+
+		if l := int(h & recordLenMask); cap(buf) < l {
+			buf = make([]byte, l)
+		} else {
+			buf = buf[:l]
 		}
 
-		buf := make([]byte, head)
-		_, err = i.idx.ReadAt(buf, i.idxOffset+4)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			i.recovery.Reason = "torn idx record"
+			break
+		}
+
+		typ := h >> recordTypeShift
+		key, index, deleted, err := decodeRecord(typ, buf)
 		if err != nil {
-			return err
+			// 新版本写的记录, 不能当成坏掉的记录截断
+			if errors.Is(err, ErrUnknownRecord) {
+				return err
+			}
+			i.recovery.Reason = err.Error()
+			break
 		}
 
-		var index IdxVersion0
-		if err = proto.Unmarshal(buf, &index); err != nil {
-			//fmt.Printf("head = %d, %x\n", head, buf)
-			return err
+		if typ != recordCurrent {
+			i.oldRecords++
 		}
 
-		var index2 Index
-		if err = deepcopy.Copy(&index2, &index).Do(); err != nil {
+		if !deleted && index.Offset+int64(index.Size) > datSize {
+			// 索引写进去了, 数据没有写完
+			i.recovery.Reason = fmt.Sprintf("key(%d) points past the end of dat", key)
+			break
+		}
+
+		i.replayRecord(key, index, deleted, i.idxOffset)
+		i.idxOffset += int64(len(buf)) + 4
+	}
+
+	// 从第一条坏掉的记录开始, 后面的都丢掉
+	if i.recovery.Reason != "" {
+		if fi, err = i.idx.Stat(); err != nil {
 			return err
 		}
-		i.idxOffset += int64(head) + 4
-		i.allIndex[int64(index2.Key)] = index2
+
+		i.recovery.DroppedIdxBytes = fi.Size() - i.idxOffset
+		// 只读打开时尾部可能是写进程正在写的记录, 忽略就行
+		if !i.opt.ReadOnly {
+			if err = i.idx.Truncate(i.idxOffset); err != nil {
+				return err
+			}
+		}
 	}
+
+	// 后面的写入从文件尾追加
+	_, err = i.idx.Seek(i.idxOffset, io.SeekStart)
+	return err
+}
+
+// 解码一条idx记录, 删除记录只有key, deleted为true
+func decodeRecord(typ uint32, buf []byte) (key int64, index Index, deleted bool, err error) {
+	if typ == recordIdxFixed {
+		return decodeFixed(buf)
+	}
+	return decodeProtoRecord(typ, buf)
+}
+
+// 解码旧版本protobuf格式的记录
+func decodeProtoRecord(typ uint32, buf []byte) (key int64, index Index, deleted bool, err error) {
+	switch typ {
+	case recordIdxVersion0:
+		var index0 IdxVersion0
+		if err = proto.Unmarshal(buf, &index0); err != nil {
+			return
+		}
+
+		if err = deepcopy.Copy(&index, &index0).Do(); err != nil {
+			return
+		}
+		return index0.Key, index, false, nil
+	case recordTombstone:
+		var tomb IdxTombstone
+		if err = proto.Unmarshal(buf, &tomb); err != nil {
+			return
+		}
+		return tomb.Key, index, true, nil
+	case recordIdxVersion1:
+		var index1 IdxVersion1
+		if err = proto.Unmarshal(buf, &index1); err != nil {
+			return
+		}
+
+		if index1.Flags&^idxFlagKnown != 0 || index1.Flags&idxFlagCompressed != 0 {
+			err = fmt.Errorf("%w:flags(%#x)", ErrUnknownRecord, index1.Flags)
+			return
+		}
+
+		if index1.Flags&idxFlagTombstone != 0 {
+			return index1.Key, index, true, nil
+		}
+
+		if err = deepcopy.Copy(&index, &index1).Do(); err != nil {
+			return
+		}
+		return index1.Key, index, false, nil
+	}
+
+	err = fmt.Errorf("%w:type(%d)", ErrUnknownRecord, typ)
+	return
+}
+
+// 编码一条写入记录
+func encodePut(key int64, index *Index) ([]byte, error) {
+	buf := make([]byte, fixedRecordLen)
+	encodeFixed(buf, key, index, 0)
+	return buf, nil
+}
+
+// 编码一条删除记录, 过期时间的位置放删除时间
+func encodeDelete(key int64) ([]byte, error) {
+	buf := make([]byte, fixedRecordLen)
+	encodeFixed(buf, key, &Index{Timeout: time.Now().UnixNano()}, idxFlagTombstone)
+	return buf, nil
+}
+
+// 重放一条idx记录到内存索引, pos是记录在idx里的位置
+func (i *IndexInMemory) replayRecord(key int64, index Index, deleted bool, pos int64) {
+	if deleted {
+		i.allIndex.delete(key)
+		return
+	}
+
+	i.allIndex.set(key, index, pos)
+	if end := index.Offset + int64(index.Size); end > i.datEnd {
+		i.datEnd = end
+	}
+
+	if key > i.maxKey {
+		i.maxKey = key
+	}
+}
+
+// 编码一条idx记录, 头4个字节是记录类型和payload长度
+func encodeRecord(typ uint32, m proto.Message) ([]byte, error) {
+	all, err := proto.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4+len(all))
+	binary.LittleEndian.PutUint32(buf, typ<<recordTypeShift|uint32(len(all)))
+	copy(buf[4:], all)
+	return buf, nil
 }
 
 func (i *IndexInMemory) loadDat(name string) (err error) {
-	i.dat, err = os.OpenFile(datName((name)), os.O_CREATE|os.O_RDWR, 0644)
+	i.dat, err = os.OpenFile(datName((name)), i.openFlag(), i.opt.FileMode)
 	return
 }
 
@@ -213,8 +566,10 @@ func (i *IndexInMemory) checkFull() (err error) {
 		return
 	}
 
-	if i.TotalSize >= int64(maxDatLimit) {
+	if i.TotalSize >= int64(i.opt.SegmentSize) {
 		i.Readonly = true
+		// 写满了, 之后只会删除, 全部合并成紧凑的表示
+		i.allIndex.seal()
 		return ErrFull
 	}
 
@@ -222,130 +577,418 @@ func (i *IndexInMemory) checkFull() (err error) {
 }
 
 func (i *IndexInMemory) updateMetadata() {
+	if i.opt.ReadOnly {
+		return
+	}
 	i.enMd.Encode(&i.metadata)
 }
 
-func (i *IndexInMemory) GetSeq() (key int64) {
-	i.rwmu.Lock()
-	key = i.Seq
-	i.Seq++
-	i.rwmu.Unlock()
+// 保存, 返回分配的key
+func (i *IndexInMemory) Put(data []byte) (key int64, err error) {
+	return i.PutWithTTL(data, 0)
+}
+
+// 保存, 超过ttl之后数据就get不到了, 等待后台删除
+func (i *IndexInMemory) PutWithTTL(data []byte, ttl time.Duration) (key int64, err error) {
+	return i.PutReader(bytes.NewReader(data), int64(len(data)), PutOptions{TTL: ttl})
+}
+
+// 流式保存, 返回分配的key
+func (i *IndexInMemory) PutReader(r io.Reader, size int64, opt PutOptions) (key int64, err error) {
+	return i.putReader(0, false, r, size, opt)
+}
+
+// 用调用者指定的key保存, key已经存在返回ErrKeyExists
+func (i *IndexInMemory) PutWithKey(key int64, data []byte) (err error) {
+	return i.PutReaderWithKey(key, bytes.NewReader(data), int64(len(data)), PutOptions{})
+}
+
+// 用调用者指定的key流式保存, key已经存在返回ErrKeyExists
+// 过期但是还没有被删除的key也算存在
+func (i *IndexInMemory) PutReaderWithKey(key int64, r io.Reader, size int64, opt PutOptions) (err error) {
+	_, err = i.putReader(key, true, r, size, opt)
 	return
 }
 
-// 保存
-func (i *IndexInMemory) Put(key int64, data []byte) (err error) {
-	if err := i.checkFull(); err != nil {
-		return err
+// 分配key和预留数据文件的空间, 需要持有写锁
+// Seq总是比已经用过的key都大, 所以自动分配的key不会冲突
+func (i *IndexInMemory) reserve(key int64, withKey bool, size int64) (_ int64, offset int64, err error) {
+	if withKey {
+		// 负数的key留给以后用, 遍历的时候从0开始
+		if key < 0 {
+			return 0, 0, fmt.Errorf("%w:key(%d)", ErrIllegalKey, key)
+		}
+		ok, err := i.allIndex.has(key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ok {
+			return 0, 0, fmt.Errorf("%w:key(%d)", ErrKeyExists, key)
+		}
+		if _, ok := i.pending[key]; ok {
+			return 0, 0, fmt.Errorf("%w:key(%d)", ErrKeyExists, key)
+		}
+	} else {
+		key = i.Seq
 	}
 
-	// TODO sync.Pool
-	var buf bytes.Buffer
+	if key >= i.Seq {
+		i.Seq = key + 1
+	}
 
-	crc := crc32.Update(0, defaultTable, data)
+	i.pending[key] = struct{}{}
+	offset = i.DatOffset
+	i.DatOffset += size
+	i.TotalSize += size
+	return key, offset, nil
+}
 
-	idx := IdxVersion0{}
-	idx.Key = key
-	idx.Size = int32(len(data))
-	idx.Offset = i.DatOffset
-	idx.Crc32 = crc
+// key是否已经被占用, 和reserve的规则一样
+func (i *IndexInMemory) HasKey(key int64) (bool, error) {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
 
-	all, err := proto.Marshal(&idx)
-	if err != nil {
-		return err
+	if _, ok := i.pending[key]; ok {
+		return true, nil
 	}
+	return i.allIndex.has(key)
+}
 
-	// 写入头
-	if err := binary.Write(&buf, binary.LittleEndian, int32(len(all))); err != nil {
-		return err
+func (i *IndexInMemory) NextKey() int64 {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
+	return i.Seq
+}
+
+func (i *IndexInMemory) SkipKeys(next int64) {
+	i.rwmu.Lock()
+	defer i.rwmu.Unlock()
+
+	if next > i.Seq {
+		i.Seq = next
 	}
+}
 
-	// 写入内容
-	binary.Write(&buf, binary.LittleEndian, all)
+// 流式保存, 从r读取size个字节直接写到数据文件
+// 先分配key, 在数据文件里预留空间, 不持有锁写数据, 写完之后再写索引,
+// 所以多个Put可以并发写数据文件, 写到一半失败的空间算作垃圾, 等压缩回收
+func (i *IndexInMemory) putReader(key int64, withKey bool, r io.Reader, size int64, opt PutOptions) (_ int64, err error) {
+	if i.opt.ReadOnly {
+		return 0, ErrReadOnly
+	}
 
+	if size < 0 || size > math.MaxInt32 {
+		return 0, fmt.Errorf("%w:%d", ErrObjectSize, size)
+	}
+
+	if err := i.checkFull(); err != nil {
+		return 0, err
+	}
+
+	meta, err := encodeMeta(opt.Meta)
+	if err != nil {
+		return 0, err
+	}
+	total := int64(len(meta)) + size
+
+	// 压缩替换文件之前会等正在写的Put结束
+	i.writeMu.RLock()
+	defer i.writeMu.RUnlock()
+
+	// 1. 分配key, 预留数据文件的空间, 元数据在前面
 	i.rwmu.Lock()
-	// 1. 写入索引文件
-	n, err := i.idx.Write(buf.Bytes())
+	key, offset, err := i.reserve(key, withKey, total)
+	i.rwmu.Unlock()
 	if err != nil {
-		i.rwmu.Unlock()
-		return err
+		return 0, err
 	}
 
-	// 3. 更新数据文件
-	if _, err := i.dat.WriteAt(data, i.DatOffset); err != nil {
-		i.idx.Truncate(i.idxOffset) //修改文件指针的大小
-		i.idx.Seek(int64(-n), 1)    //修改文件偏移指针
+	// 索引没写成功, 预留的空间算作垃圾
+	defer func() {
+		if err == nil {
+			return
+		}
+
+		i.rwmu.Lock()
+		if _, ok := i.pending[key]; ok {
+			delete(i.pending, key)
+			i.DeleteSize += total
+		}
 		i.rwmu.Unlock()
-		return err
+	}()
+
+	// 2. 写数据文件, 边写边算crc
+	if len(meta) > 0 {
+		if _, err = i.dat.WriteAt(meta, offset); err != nil {
+			return 0, err
+		}
+		offset += int64(len(meta))
+	}
+
+	h := crc32.New(defaultTable)
+	_, err = io.CopyN(&offsetWriter{w: i.dat, off: offset}, io.TeeReader(r, h), size)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
-	// 2. 更新offset
-	i.DatOffset += int64(len(data))
-	i.idxOffset += int64(len(all)) + 4
 
-	var idxMem Index
-	err = deepcopy.Copy(&idxMem, &idx).Do()
 	if err != nil {
+		return 0, err
+	}
+
+	idxMem := Index{
+		Key:      key,
+		Size:     int32(size),
+		Offset:   offset,
+		Crc32:    h.Sum32(),
+		Cookie:   opt.Cookie,
+		MetaSize: int32(len(meta)),
+	}
+	if opt.TTL > 0 {
+		idxMem.Timeout = time.Now().Add(opt.TTL).UnixNano()
+	}
+
+	var buf [fixedRecordLen]byte
+	encodeFixed(buf[:], key, &idxMem, 0)
+
+	// 3. 写入索引文件
+	i.rwmu.Lock()
+	pos := i.idxOffset
+	n, err := i.idx.Write(buf[:])
+	if err != nil {
+		i.idx.Truncate(i.idxOffset) //修改文件指针的大小
+		i.idx.Seek(i.idxOffset, io.SeekStart)
 		i.rwmu.Unlock()
-		return err
+		return 0, err
 	}
-	i.allIndex[i.Seq] = idxMem
-	i.Seq++
+	i.idxOffset += int64(n)
+
+	delete(i.pending, key)
+	// 和重放一样更新datEnd和maxKey, 写快照要用
+	i.replayRecord(key, idxMem, false, pos)
 	i.FileCount++
 	i.updateMetadata()
+	ticket := i.gc.add()
 	i.rwmu.Unlock()
-	return nil
+	return key, i.waitSync(ticket)
 }
 
 // 获取
 func (i *IndexInMemory) Get(key int64) (element Data, ok bool, err error) {
+	return i.GetRange(key, 0, -1)
+}
+
+// 只返回索引, 不读数据
+func (i *IndexInMemory) Stat(key int64) (index Index, ok bool, err error) {
 	i.rwmu.RLock()
-	element.Index, ok = i.allIndex[key]
-	if !ok {
-		i.rwmu.RUnlock()
+	defer i.rwmu.RUnlock()
+
+	index, ok, err = i.allIndex.get(key)
+	if err != nil || !ok || index.expired(time.Now().UnixNano()) {
+		return Index{}, false, err
+	}
+	return
+}
+
+// 读取[offset, offset+length)范围内的数据, length小于0或者超过结尾表示读到结尾
+// element.Index是整个对象的索引, element.Data只有范围内的数据
+// 读整个对象时校验crc; 只读一部分时默认不校验, Options.VerifyRange为true时把整个对象读一遍校验
+func (i *IndexInMemory) GetRange(key int64, offset, length int64) (element Data, ok bool, err error) {
+	i.rwmu.RLock()
+	defer i.rwmu.RUnlock()
+
+	element.Index, ok, err = i.allIndex.get(key)
+	if err != nil || !ok || element.expired(time.Now().UnixNano()) {
+		return Data{}, false, err
+	}
+
+	size := int64(element.Size)
+	if offset < 0 || offset > size {
+		err = fmt.Errorf("%w:offset(%d) size(%d)", ErrRange, offset, size)
+		return
+	}
+
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+
+	if element.Meta, err = readMeta(i.dat, key, element.Index); err != nil {
 		return
 	}
 
 	// TODO sync.Pool
-	element.Data = make([]byte, element.Size)
-	i.dat.ReadAt(element.Data, element.Offset)
-	crc := crc32.Checksum(element.Data, defaultTable)
-	if crc != element.Crc32 {
-		err = fmt.Errorf("The data file is bad:key(%d)\n", key)
-		i.rwmu.RUnlock()
+	element.Data = make([]byte, length)
+	if _, err = i.dat.ReadAt(element.Data, element.Offset+offset); err != nil {
 		return
 	}
 
-	i.rwmu.RUnlock()
+	var crc uint32
+	switch {
+	case length == size:
+		crc = crc32.Checksum(element.Data, defaultTable)
+	case i.opt.VerifyRange:
+		h := crc32.New(defaultTable)
+		if _, err = io.Copy(h, io.NewSectionReader(i.dat, element.Offset, size)); err != nil {
+			return
+		}
+		crc = h.Sum32()
+	default:
+		return
+	}
+
+	if crc != element.Crc32 {
+		err = fmt.Errorf("%w:key(%d)", ErrBadData, key)
+	}
 	return
 }
 
 // 删除
 func (i *IndexInMemory) Delete(key int64) error {
+	if i.opt.ReadOnly {
+		return ErrReadOnly
+	}
+
+	buf, err := encodeDelete(key)
+	if err != nil {
+		return err
+	}
+
 	i.rwmu.Lock()
-	delete(i.allIndex, key)
+	index, ok, err := i.allIndex.get(key)
+	if err != nil || !ok {
+		i.rwmu.Unlock()
+		return err
+	}
+
+	// 先写墓碑记录, 重启之后重放idx的时候被删除的数据才不会回来
+	n, err := i.idx.Write(buf)
+	if err != nil {
+		i.idx.Truncate(i.idxOffset)
+		i.idx.Seek(i.idxOffset, io.SeekStart)
+		i.rwmu.Unlock()
+		return err
+	}
+	i.idxOffset += int64(n)
+
+	i.allIndex.delete(key)
 	i.DeleteCount++
+	i.DeleteSize += index.diskSize()
 	i.updateMetadata()
+	ticket := i.gc.add()
 	i.rwmu.Unlock()
+	return i.waitSync(ticket)
+}
+
+// 把过期的数据转成删除
+func (i *IndexInMemory) Expire(now time.Time) (n int, err error) {
+	nano := now.UnixNano()
+
+	i.rwmu.RLock()
+	var keys []int64
+	err = i.allIndex.eachTTL(func(key int64, index Index) bool {
+		if index.expired(nano) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	i.rwmu.RUnlock()
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		if err = i.Delete(key); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// 从start开始按key的顺序遍历没有过期的数据, 最多limit条, limit小于等于0不限, fn返回false停止
+// 开始的时候在读锁下取出这limit条, 遍历期间的写入和删除看不到
+func (i *IndexInMemory) Scan(start int64, limit int, fn func(key int64, index Index) bool) error {
+	now := time.Now().UnixNano()
+
+	i.rwmu.RLock()
+	items, err := i.allIndex.ascend(start, limit, func(index Index) bool {
+		return !index.expired(now)
+	})
+	i.rwmu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if !fn(item.key, item.Index) {
+			break
+		}
+	}
 	return nil
 }
 
 // close
 func (i *IndexInMemory) Close() (err error) {
+	if i.stopSync != nil {
+		i.stopSync()
+	}
+
+	if i.stopSnap != nil {
+		i.stopSnap()
+	}
+
+	// 快照写失败不影响关闭, 下次启动重放的idx多一点
+	i.compactMu.Lock()
+	if e := i.autoSnapshot(); e != nil {
+		i.opt.Logger.Printf("snapshot %s:%s", i.name, e)
+	}
+	i.compactMu.Unlock()
+
+	// 等正在写数据文件的Put结束
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
 	i.rwmu.Lock()
 	defer i.rwmu.Unlock()
 
-	if err = i.idx.Sync(); err != nil {
-		return err
+	if !i.opt.ReadOnly {
+		if err = i.idx.Sync(); err != nil {
+			return err
+		}
+
+		if err = i.dat.Sync(); err != nil {
+			return err
+		}
+
+		if err = i.md.Sync(); err != nil {
+			return err
+		}
 	}
+	return i.closeFiles()
+}
 
-	if err = i.dat.Sync(); err != nil {
-		return err
+// 关闭马上要删除的存储引擎, 等正在写的Put和压缩结束, 不写快照, 不刷盘
+func (i *IndexInMemory) Discard() error {
+	if i.stopSync != nil {
+		i.stopSync()
 	}
 
-	if err = i.md.Sync(); err != nil {
-		return err
+	if i.stopSnap != nil {
+		i.stopSnap()
 	}
 
+	i.compactMu.Lock()
+	defer i.compactMu.Unlock()
+	i.writeMu.Lock()
+	defer i.writeMu.Unlock()
+	i.rwmu.Lock()
+	defer i.rwmu.Unlock()
+	return i.closeFiles()
+}
+
+// 需要持有rwmu
+func (i *IndexInMemory) closeFiles() (err error) {
+	i.fileMu.Lock()
+	defer i.fileMu.Unlock()
+
 	if err = i.idx.Close(); err != nil {
 		return err
 	}
@@ -354,5 +997,12 @@ func (i *IndexInMemory) Close() (err error) {
 		return err
 	}
 
+	// 磁盘索引打开的查找文件
+	if c, ok := i.allIndex.(io.Closer); ok {
+		if err = c.Close(); err != nil {
+			return err
+		}
+	}
+
 	return i.md.Close()
 }
@@ -3,11 +3,33 @@ package storage
 import (
 	"fmt"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// newIndexInMemory打开时用的选项
+var testOptions Options
+
+func newIndexInMemory(fileName string) (idx *IndexInMemory, err error) {
+	opt := testOptions
+	return openIndexInMemory(fileName, &opt)
+}
+
+func TestMain(m *testing.M) {
+	os.MkdirAll("./testdata", 0755)
+	if code := m.Run(); code != 0 {
+		os.Exit(code)
+	}
+
+	// 同样的用例用磁盘索引再跑一遍
+	testOptions.DiskIndex = true
+	os.Exit(m.Run())
+}
+
 // 测试初始化函数
 func Test_NewIndexInMemory(t *testing.T) {
 
@@ -34,7 +56,7 @@ func Test_PutAndGet_Once(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEqual(t, i, nil)
 
-	err = i.Put(0, []byte("hello world"))
+	err = i.PutWithKey(0, []byte("hello world"))
 	assert.NoError(t, err)
 
 	elem, ok, err := i.Get(0)
@@ -55,7 +77,7 @@ func Test_PutAndGet(t *testing.T) {
 
 	for i := int64(0); i < 100; i++ {
 
-		err = index.Put(i, []byte(fmt.Sprintf("hello world:%d", i)))
+		err = index.PutWithKey(i, []byte(fmt.Sprintf("hello world:%d", i)))
 		assert.NoError(t, err)
 	}
 
@@ -80,7 +102,7 @@ func Test_PutDeleteGet_Once(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEqual(t, i, nil)
 
-	err = i.Put(0, []byte("hello world"))
+	err = i.PutWithKey(0, []byte("hello world"))
 	assert.NoError(t, err)
 
 	elem, ok, err := i.Get(0)
@@ -94,3 +116,198 @@ func Test_PutDeleteGet_Once(t *testing.T) {
 	assert.False(t, ok)
 	assert.NotEqual(t, elem.Data, []byte("hello world"))
 }
+
+// put delete之后重新打开, 被删除的数据不能回来
+func Test_PutDeleteReopen(t *testing.T) {
+
+	os.Remove("./testdata/3.dat")
+	os.Remove("./testdata/3.idx")
+	os.Remove("./testdata/3.meta")
+
+	i, err := newIndexInMemory("./testdata/3")
+	assert.NoError(t, err)
+
+	for k := int64(0); k < 3; k++ {
+		err = i.PutWithKey(k, []byte(fmt.Sprintf("hello world:%d", k)))
+		assert.NoError(t, err)
+	}
+
+	assert.NoError(t, i.Delete(1))
+	assert.NoError(t, i.Close())
+
+	i, err = newIndexInMemory("./testdata/3")
+	assert.NoError(t, err)
+	defer i.Close()
+
+	_, ok, err := i.Get(1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	for _, k := range []int64{0, 2} {
+		elem, ok, err := i.Get(k)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, elem.Data, []byte(fmt.Sprintf("hello world:%d", k)))
+	}
+}
+
+// 过期之后get不到, Expire之后重启也get不到
+func Test_PutWithTTL(t *testing.T) {
+
+	os.Remove("./testdata/4.dat")
+	os.Remove("./testdata/4.idx")
+	os.Remove("./testdata/4.meta")
+
+	i, err := newIndexInMemory("./testdata/4")
+	assert.NoError(t, err)
+
+	key, err := i.PutWithTTL([]byte("hello world"), 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, key, int64(0))
+	assert.NoError(t, i.PutWithKey(1, []byte("hello world")))
+
+	_, ok, err := i.Get(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	time.Sleep(100 * time.Millisecond)
+	_, ok, err = i.Get(0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	n, err := i.Expire(time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, n, 1)
+	assert.NoError(t, i.Close())
+
+	i, err = newIndexInMemory("./testdata/4")
+	assert.NoError(t, err)
+	defer i.Close()
+
+	_, ok, err = i.Get(0)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = i.Get(1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+// 只读打开可以和写进程共存, 不创建也不修改文件, 有读者时压缩不替换文件
+func Test_ReadOnly(t *testing.T) {
+
+	os.Remove("./testdata/5.dat")
+	os.Remove("./testdata/5.idx")
+	os.Remove("./testdata/5.meta")
+
+	_, err := openIndexInMemory("./testdata/5", &Options{ReadOnly: true})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat("./testdata/5.idx")
+	assert.True(t, os.IsNotExist(err))
+
+	w, err := newIndexInMemory("./testdata/5")
+	assert.NoError(t, err)
+	defer w.Close()
+	assert.NoError(t, w.PutWithKey(0, []byte("hello world")))
+	assert.NoError(t, w.PutWithKey(1, []byte("hello world")))
+	assert.NoError(t, w.Delete(1))
+
+	meta, err := os.ReadFile("./testdata/5.meta")
+	assert.NoError(t, err)
+
+	r, err := openIndexInMemory("./testdata/5", &Options{ReadOnly: true})
+	assert.NoError(t, err)
+
+	elem, ok, err := r.Get(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, elem.Data, []byte("hello world"))
+
+	assert.ErrorIs(t, r.PutWithKey(2, []byte("hello world")), ErrReadOnly)
+	assert.ErrorIs(t, r.Delete(0), ErrReadOnly)
+	assert.ErrorIs(t, w.Compact(), ErrInUse)
+
+	meta2, err := os.ReadFile("./testdata/5.meta")
+	assert.NoError(t, err)
+	assert.Equal(t, meta, meta2)
+
+	assert.NoError(t, r.Close())
+	assert.NoError(t, w.Compact())
+}
+
+// cookie和数据一起保存, 重启之后还在
+func Test_PutCookie(t *testing.T) {
+	name := "./testdata/cookie"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	assert.NoError(t, index.PutReaderWithKey(0, strings.NewReader("hello"), 5, PutOptions{Cookie: 0x1234abcd}))
+	assert.NoError(t, index.Close())
+
+	index, err = newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	idx, ok, err := index.Stat(0)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, idx.Cookie, uint32(0x1234abcd))
+}
+
+// 并发写入, 返回的key和保存的key一致
+func Test_PutConcurrentKey(t *testing.T) {
+	name := "./testdata/put_key"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	var wg sync.WaitGroup
+	keys := make([]int64, 20)
+	for n := range keys {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			key, err := index.Put([]byte(fmt.Sprintf("hello world:%d", n)))
+			assert.NoError(t, err)
+			keys[n] = key
+		}(n)
+	}
+	wg.Wait()
+
+	for n, key := range keys {
+		elem, ok, err := index.Get(key)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, string(elem.Data), fmt.Sprintf("hello world:%d", n))
+	}
+}
+
+// 指定key写入, 重复的key返回ErrKeyExists, 之后分配的key不会和它冲突
+func Test_PutWithKey(t *testing.T) {
+	name := "./testdata/put_with_key"
+	removeIndexFiles(name)
+
+	index, err := newIndexInMemory(name)
+	assert.NoError(t, err)
+	defer index.Close()
+
+	const id = int64(1) << 50
+	assert.NoError(t, index.PutWithKey(id, []byte("hello")))
+	assert.ErrorIs(t, index.PutWithKey(id, []byte("world")), ErrKeyExists)
+
+	key, err := index.Put([]byte("world"))
+	assert.NoError(t, err)
+	assert.Equal(t, key, id+1)
+
+	elem, ok, err := index.Get(id)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, string(elem.Data), "hello")
+
+	// 删除之后可以再用
+	assert.NoError(t, index.Delete(id))
+	assert.NoError(t, index.PutWithKey(id, []byte("again")))
+}
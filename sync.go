@@ -0,0 +1,83 @@
+package storage
+
+import "sync"
+
+// 组提交
+// 每个写入在持有写锁的时候领一个递增的票号, 释放锁之后等待自己的票号被刷盘
+// 第一个发现没人在刷盘的写入者成为leader, 把目前为止所有的写入一起刷盘,
+// 刷盘期间到达的写入等下一轮, 这样并发的写入只需要少数几次fsync
+type groupCommit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending uint64 // 已经写入的最大票号
+	synced  uint64 // 已经刷盘的最大票号
+	syncing bool
+	// 刷盘失败之后数据是否落盘已经不可知, 之后的写入都返回这个错误
+	err error
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// 领票号, 需要在写入完成之后, 释放写锁之前调用
+func (g *groupCommit) add() (ticket uint64) {
+	g.mu.Lock()
+	g.pending++
+	ticket = g.pending
+	g.mu.Unlock()
+	return
+}
+
+// 等待票号对应的写入落盘
+func (g *groupCommit) wait(ticket uint64, sync func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for g.synced < ticket && g.err == nil {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+
+		g.syncing = true
+		target := g.pending
+		g.mu.Unlock()
+		err := sync()
+		g.mu.Lock()
+		g.syncing = false
+		if err != nil {
+			g.err = err
+		} else {
+			g.synced = target
+		}
+		g.cond.Broadcast()
+	}
+
+	return g.err
+}
+
+// 把idx和dat刷到磁盘
+// 不持有rwmu, 刷盘期间的写入和删除不用等磁盘, fileMu保证文件不会被替换或者关闭
+func (i *IndexInMemory) sync() error {
+	i.fileMu.RLock()
+	defer i.fileMu.RUnlock()
+
+	if err := i.dat.Sync(); err != nil {
+		return err
+	}
+	return i.idx.Sync()
+}
+
+// 按照刷盘策略等待写入落盘, ticket是写入时领的票号
+func (i *IndexInMemory) waitSync(ticket uint64) error {
+	switch i.opt.Sync {
+	case SyncAlways:
+		return i.sync()
+	case SyncGroup:
+		return i.gc.wait(ticket, i.sync)
+	}
+	return nil
+}
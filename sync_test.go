@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 并发的写入合并刷盘, 每个写入返回的时候自己的票号都已经刷过盘
+func Test_GroupCommit(t *testing.T) {
+	g := newGroupCommit()
+
+	var count int32
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ticket := g.add()
+			err := g.wait(ticket, func() error {
+				atomic.AddInt32(&count, 1)
+				return nil
+			})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, g.synced, g.pending)
+	assert.LessOrEqual(t, atomic.LoadInt32(&count), int32(100))
+}
+
+// 刷盘失败之后, 之后的写入都返回错误
+func Test_GroupCommitError(t *testing.T) {
+	g := newGroupCommit()
+	errSync := errors.New("sync fail")
+
+	err := g.wait(g.add(), func() error { return errSync })
+	assert.ErrorIs(t, err, errSync)
+
+	err = g.wait(g.add(), func() error { return nil })
+	assert.ErrorIs(t, err, errSync)
+}
+
+func Test_PutSyncMode(t *testing.T) {
+	for _, mode := range []SyncMode{SyncAlways, SyncInterval, SyncGroup} {
+		name := fmt.Sprintf("./testdata/sync_%s", mode)
+		removeIndexFiles(name)
+
+		index, err := openIndexInMemory(name, &Options{Sync: mode})
+		assert.NoError(t, err)
+
+		var wg sync.WaitGroup
+		for i := int64(0); i < 10; i++ {
+			wg.Add(1)
+			go func(i int64) {
+				defer wg.Done()
+				assert.NoError(t, index.PutWithKey(i, []byte("hello world")))
+			}(i)
+		}
+		wg.Wait()
+		assert.NoError(t, index.Close())
+	}
+}
+
+// 刷盘不持有索引的锁, 刷盘期间的写入和删除不用等磁盘
+func Test_SyncWithoutIndexLock(t *testing.T) {
+	name := "./testdata/sync_unlocked"
+	removeIndexFiles(name)
+
+	index, err := openIndexInMemory(name, &Options{})
+	assert.NoError(t, err)
+	defer index.Close()
+
+	key, err := index.Put([]byte("hello"))
+	assert.NoError(t, err)
+
+	// 模拟一次很慢的刷盘
+	index.fileMu.RLock()
+	done := make(chan error, 1)
+	go func() {
+		if _, err := index.Put([]byte("world")); err != nil {
+			done <- err
+			return
+		}
+		done <- index.Delete(key)
+	}()
+
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Error("put and delete blocked by sync")
+	}
+	index.fileMu.RUnlock()
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package storage
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// 把目录项刷到磁盘, 新建, rename和删除文件之后调用, 崩溃之后目录里看到的还是这几步的结果
+func syncDir(name string) error {
+	d, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+
+	err = d.Sync()
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	return err
+}
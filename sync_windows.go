@@ -0,0 +1,8 @@
+//go:build windows
+
+package storage
+
+// windows下不能打开目录刷盘, rename本身由文件系统保证
+func syncDir(name string) error {
+	return nil
+}